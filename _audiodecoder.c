@@ -0,0 +1,241 @@
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <arpa/inet.h>
+#include <unistd.h>
+
+#include <libavcodec/avcodec.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/mem.h>
+#include <libswresample/swresample.h>
+
+static const AVCodec *codec = NULL;
+static unsigned char *audio_packet = NULL;
+static bool audio_packet_config = false;
+static int64_t audio_packet_pts = AV_NOPTS_VALUE;
+static AVCodecContext *codec_ctx = NULL;
+static SwrContext *swr_ctx = NULL;
+static AVFrame *frame = NULL;
+static AVPacket *packet = NULL;
+static unsigned char *pcm_data = NULL;
+static int pcm_samples = 0;
+
+static const AVCodec *get_decoder(char **argv) {
+  switch (strtoul(argv[1], NULL, 10)) {
+  case 0x6f707573:
+    return avcodec_find_decoder(AV_CODEC_ID_OPUS);
+  case 0x00616163:
+    return avcodec_find_decoder(AV_CODEC_ID_AAC);
+  case 0x666c6163:
+    return avcodec_find_decoder(AV_CODEC_ID_FLAC);
+  default:
+    break;
+  }
+
+  return NULL;
+}
+
+static int read_audio_packet(void) {
+  unsigned char header[12];
+  if (read(STDIN_FILENO, header, sizeof(header)) != sizeof(header)) {
+    return 0;
+  }
+
+  uint32_t size;
+  memcpy(&size, header + 8, sizeof(size));
+  size = ntohl(size);
+
+  uint32_t pts_high;
+  uint32_t pts_low;
+  memcpy(&pts_high, header, sizeof(pts_high));
+  memcpy(&pts_low, header + 4, sizeof(pts_low));
+  pts_high = ntohl(pts_high);
+  pts_low = ntohl(pts_low);
+
+  audio_packet_config = pts_high & 0x80000000;
+
+  if (audio_packet_config) {
+    audio_packet_pts = AV_NOPTS_VALUE;
+  } else {
+    audio_packet_pts = ((int64_t)(pts_high & 0x3FFFFFFF) << 32) | pts_low;
+  }
+
+  audio_packet = malloc(size + AV_INPUT_BUFFER_PADDING_SIZE);
+  if (!audio_packet) {
+    return 0;
+  }
+
+  memset(audio_packet + size, 0, AV_INPUT_BUFFER_PADDING_SIZE);
+
+  unsigned char *data = audio_packet;
+  int len = size;
+
+  while (len > 0) {
+    int r = read(STDIN_FILENO, data, len);
+    if (r <= 0) {
+      return 0;
+    }
+    data += r;
+    len -= r;
+  }
+
+  return size;
+}
+
+static bool open_decoder(unsigned char *config, int len) {
+  if (codec->id == AV_CODEC_ID_FLAC && len >= 8 &&
+      !memcmp(config, "fLaC", 4)) {
+    config += 8;
+    len -= 8;
+  }
+
+  avcodec_free_context(&codec_ctx);
+
+  codec_ctx = avcodec_alloc_context3(codec);
+  if (!codec_ctx) {
+    return false;
+  }
+
+  codec_ctx->extradata = av_mallocz(len + AV_INPUT_BUFFER_PADDING_SIZE);
+  if (!codec_ctx->extradata) {
+    return false;
+  }
+
+  memcpy(codec_ctx->extradata, config, len);
+  codec_ctx->extradata_size = len;
+  codec_ctx->sample_rate = 48000;
+  av_channel_layout_default(&codec_ctx->ch_layout, 2);
+
+  return avcodec_open2(codec_ctx, codec, NULL) >= 0;
+}
+
+static bool write_frame(void) {
+  AVChannelLayout stereo = AV_CHANNEL_LAYOUT_STEREO;
+
+  if (!swr_ctx) {
+    if (swr_alloc_set_opts2(&swr_ctx, &stereo, AV_SAMPLE_FMT_S16, 48000,
+                            &frame->ch_layout, frame->format,
+                            frame->sample_rate, 0, NULL) < 0) {
+      return false;
+    }
+
+    if (swr_init(swr_ctx) < 0) {
+      return false;
+    }
+  }
+
+  int samples = swr_get_out_samples(swr_ctx, frame->nb_samples);
+
+  if (samples > pcm_samples) {
+    free(pcm_data);
+
+    pcm_samples = samples;
+    pcm_data = malloc(pcm_samples * 4);
+
+    if (!pcm_data) {
+      return false;
+    }
+  }
+
+  samples = swr_convert(swr_ctx, &pcm_data, pcm_samples,
+                        (const uint8_t **)frame->extended_data,
+                        frame->nb_samples);
+  if (samples < 0) {
+    return false;
+  }
+
+  write(STDOUT_FILENO, pcm_data, samples * 4);
+
+  return true;
+}
+
+static bool init(char **argv) {
+  codec = get_decoder(argv);
+  if (!codec) {
+    return false;
+  }
+
+  frame = av_frame_alloc();
+  if (!frame) {
+    return false;
+  }
+
+  packet = av_packet_alloc();
+  if (!packet) {
+    return false;
+  }
+
+  return true;
+}
+
+static void decode_loop(void) {
+  for (;;) {
+    int len = read_audio_packet();
+    if (len == 0) {
+      return;
+    }
+
+    if (audio_packet_config) {
+      swr_free(&swr_ctx);
+
+      if (!open_decoder(audio_packet, len)) {
+        return;
+      }
+    } else if (codec_ctx) {
+      packet->data = audio_packet;
+      packet->size = len;
+      packet->pts = audio_packet_pts;
+
+      if (avcodec_send_packet(codec_ctx, packet) < 0) {
+        return;
+      }
+
+      for (;;) {
+        int r = avcodec_receive_frame(codec_ctx, frame);
+        if (r == AVERROR(EAGAIN) || r == AVERROR_EOF) {
+          break;
+        }
+        if (r < 0) {
+          return;
+        }
+
+        if (!write_frame()) {
+          return;
+        }
+
+        av_frame_unref(frame);
+      }
+    }
+
+    free(audio_packet);
+    audio_packet = NULL;
+  }
+}
+
+int main(int argc, char **argv) {
+  if (argc != 2) {
+    return 0;
+  }
+
+  if (init(argv)) {
+    decode_loop();
+  }
+
+  if (audio_packet) {
+    free(audio_packet);
+  }
+
+  if (pcm_data) {
+    free(pcm_data);
+  }
+
+  swr_free(&swr_ctx);
+  avcodec_free_context(&codec_ctx);
+  av_frame_free(&frame);
+  av_packet_free(&packet);
+
+  return 0;
+}
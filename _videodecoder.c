@@ -8,11 +8,13 @@
 #include <unistd.h>
 
 #include <libavcodec/avcodec.h>
+#include <libavutil/imgutils.h>
 #include <libswscale/swscale.h>
 
 static bool raw = false;
-static bool alpha = false;
+static enum AVPixelFormat pix_fmt = AV_PIX_FMT_RGB24;
 static unsigned char *video_packet = NULL;
+static int64_t video_packet_pts = AV_NOPTS_VALUE;
 static AVCodecParserContext *parser = NULL;
 static AVCodecContext *codec_ctx = NULL;
 static struct SwsContext *sws_ctx = NULL;
@@ -25,6 +27,24 @@ static uint32_t frame_height = 0;
 static size_t frame_size = 0;
 static unsigned char *frame_data = NULL;
 
+static bool get_pix_fmt(char **argv) {
+  if (!strcmp(argv[3], "0") || !strcmp(argv[3], "rgb24")) {
+    pix_fmt = AV_PIX_FMT_RGB24;
+  } else if (!strcmp(argv[3], "1") || !strcmp(argv[3], "rgba")) {
+    pix_fmt = AV_PIX_FMT_RGBA;
+  } else if (!strcmp(argv[3], "bgra")) {
+    pix_fmt = AV_PIX_FMT_BGRA;
+  } else if (!strcmp(argv[3], "gray8")) {
+    pix_fmt = AV_PIX_FMT_GRAY8;
+  } else if (!strcmp(argv[3], "yuv420p")) {
+    pix_fmt = AV_PIX_FMT_YUV420P;
+  } else {
+    return false;
+  }
+
+  return true;
+}
+
 static const AVCodec *get_decoder(char **argv) {
   switch (strtoul(argv[1], NULL, 10)) {
   case 0x68323634:
@@ -50,6 +70,19 @@ static int read_video_packet(void) {
   memcpy(&size, header + 8, sizeof(size));
   size = ntohl(size);
 
+  uint32_t pts_high;
+  uint32_t pts_low;
+  memcpy(&pts_high, header, sizeof(pts_high));
+  memcpy(&pts_low, header + 4, sizeof(pts_low));
+  pts_high = ntohl(pts_high);
+  pts_low = ntohl(pts_low);
+
+  if (pts_high & 0x80000000) {
+    video_packet_pts = AV_NOPTS_VALUE;
+  } else {
+    video_packet_pts = ((int64_t)(pts_high & 0x3FFFFFFF) << 32) | pts_low;
+  }
+
   video_packet = malloc(size);
   if (!video_packet) {
     return 0;
@@ -104,11 +137,7 @@ static bool init(char **argv) {
     raw = true;
   }
 
-  if (atoi(argv[3])) {
-    alpha = true;
-  }
-
-  return true;
+  return get_pix_fmt(argv);
 }
 
 static void decode_loop(void) {
@@ -122,7 +151,8 @@ static void decode_loop(void) {
 
     while (len > 0) {
       int r = av_parser_parse2(parser, codec_ctx, &packet->data, &packet->size,
-                               data, len, AV_NOPTS_VALUE, AV_NOPTS_VALUE, 0);
+                               data, len, video_packet_pts, video_packet_pts,
+                               0);
 
       if (r < 0) {
         return;
@@ -156,7 +186,8 @@ static void decode_loop(void) {
               initial_height = frame_height;
             }
 
-            frame_size = frame_width * frame_height * (alpha ? 4 : 3);
+            frame_size = av_image_get_buffer_size(pix_fmt, frame_width,
+                                                  frame_height, 1);
             frame_data = malloc(frame_size);
 
             if (!frame_data) {
@@ -168,22 +199,28 @@ static void decode_loop(void) {
                        frame->height == initial_height)) {
             sws_ctx = sws_getCachedContext(
                 sws_ctx, frame_width, frame_height, codec_ctx->pix_fmt,
-                frame_width, frame_height,
-                alpha ? AV_PIX_FMT_RGBA : AV_PIX_FMT_RGB24, SWS_FAST_BILINEAR,
-                NULL, NULL, NULL);
+                frame_width, frame_height, pix_fmt, SWS_FAST_BILINEAR, NULL,
+                NULL, NULL);
 
             if (!sws_ctx) {
               return;
             }
 
-            int stride = (alpha ? 4 : 3) * frame_width;
+            uint8_t *planes[4];
+            int strides[4];
+
+            av_image_fill_arrays(planes, strides, frame_data, pix_fmt,
+                                 frame_width, frame_height, 1);
 
             sws_scale(sws_ctx, (const uint8_t *const *)frame->data,
-                      frame->linesize, 0, frame_height, &frame_data, &stride);
+                      frame->linesize, 0, frame_height, planes, strides);
 
             if (!raw) {
+              uint64_t frame_pts = frame->pts == AV_NOPTS_VALUE ? 0 : frame->pts;
+
               write(STDOUT_FILENO, &frame_width, sizeof(frame_width));
               write(STDOUT_FILENO, &frame_height, sizeof(frame_height));
+              write(STDOUT_FILENO, &frame_pts, sizeof(frame_pts));
             }
 
             write(STDOUT_FILENO, frame_data, frame_size);
@@ -2,22 +2,51 @@ package main
 
 import (
 	"encoding/binary"
-	"io"
 	"net/http"
 	"strconv"
 )
 
+type audioContainer struct {
+	format              string
+	audioSpecificConfig []byte
+	oggSerial           uint32
+	oggSequence         uint32
+	oggGranule          uint64
+	oggStarted          bool
+	flacStarted         bool
+}
+
+var audioOggCrcTable [256]uint32 = func() [256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		crc := uint32(i) << 24
+
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
 func audioSendStream(w http.ResponseWriter, req *http.Request, header bool) {
 	if !config.Scrcpy.Audio {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	select {
-	case <-audioConnectedChannel:
-	case <-req.Context().Done():
+	packets := audioBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
 		return
 	}
+	defer audioBroadcaster.unsubscribe(packets)
 
 	if req.Header.Get("Origin") != "" {
 		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec")
@@ -26,83 +55,271 @@ func audioSendStream(w http.ResponseWriter, req *http.Request, header bool) {
 	w.Header().Set("Device-Name", deviceName)
 	w.Header().Set("Codec", strconv.FormatUint(uint64(audioCodec), 10))
 
-	headerBytes := make([]byte, 12)
-	var packetSize int
-	var packet []byte
+	var data []byte
 	var n int
 	var err error
 
-	if header {
-		var data []byte
+	for packet := range packets {
+		if header {
+			data = packet
+		} else {
+			data = packet[12:]
+		}
 
-		for {
-			n, err = io.ReadFull(audioSocket, headerBytes)
-			if err != nil {
-				break
-			}
-			if n != 12 {
-				break
-			}
+		n, err = w.Write(data)
+		if err != nil {
+			break
+		}
+		if n < len(data) {
+			break
+		}
 
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
+		w.(http.Flusher).Flush()
+	}
+}
 
-			n, err = io.ReadFull(audioSocket, packet)
-			if err != nil {
-				break
-			}
-			if n != packetSize {
-				break
-			}
+func audioWavHeader() []byte {
+	header := []byte("RIFF")
+	header = binary.LittleEndian.AppendUint32(header, 0xFFFFFFFF)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint32(header, 48000)
+	header = binary.LittleEndian.AppendUint32(header, 48000*4)
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, 0xFFFFFFFF)
 
-			data = make([]byte, 12+packetSize)
-			copy(data[:12], headerBytes)
-			copy(data[12:12+packetSize], packet)
+	return header
+}
 
-			n, err = w.Write(data)
-			if err != nil {
-				connectionControlChannel <- false
-				break
-			}
-			if n < 12+packetSize {
-				connectionControlChannel <- false
-				break
-			}
+func audioOggPage(headerType byte, granule uint64, serial uint32, sequence uint32, packet []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0x00, headerType)
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = binary.LittleEndian.AppendUint32(page, sequence)
+	page = binary.LittleEndian.AppendUint32(page, 0)
 
-			w.(http.Flusher).Flush()
-		}
+	segments := len(packet)/255 + 1
+	page = append(page, byte(segments))
+
+	for i := 0; i < segments-1; i++ {
+		page = append(page, 0xFF)
+	}
+
+	page = append(page, byte(len(packet)%255))
+	page = append(page, packet...)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ audioOggCrcTable[byte(crc>>24)^b]
+	}
+
+	binary.LittleEndian.PutUint32(page[22:], crc)
+
+	return page
+}
+
+func audioOpusSamples(packet []byte) uint64 {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+
+	var frameSize uint64
+	if config < 12 {
+		frameSize = []uint64{480, 960, 1920, 2880}[config&3]
+	} else if config < 16 {
+		frameSize = []uint64{480, 960}[config&1]
 	} else {
-		for {
-			n, err = io.ReadFull(audioSocket, headerBytes)
-			if err != nil {
-				break
-			}
-			if n != 12 {
-				break
-			}
+		frameSize = []uint64{120, 240, 480, 960}[config&3]
+	}
 
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
+	switch packet[0] & 3 {
+	case 0:
+		return frameSize
+	case 1, 2:
+		return frameSize * 2
+	}
+
+	if len(packet) < 2 {
+		return 0
+	}
+
+	return frameSize * uint64(packet[1]&0x3F)
+}
+
+func audioAdtsHeader(audioSpecificConfig []byte, size int) []byte {
+	objectType := audioSpecificConfig[0] >> 3
+	frequencyIndex := (audioSpecificConfig[0]&0x07)<<1 | audioSpecificConfig[1]>>7
+	channelConfig := (audioSpecificConfig[1] >> 3) & 0x0F
+	frameLength := 7 + size
+
+	return []byte{
+		0xFF,
+		0xF1,
+		(objectType-1)<<6 | frequencyIndex<<2 | channelConfig>>2,
+		(channelConfig&0x03)<<6 | byte(frameLength>>11),
+		byte(frameLength >> 3),
+		byte(frameLength&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+func audioFlacHeader(streamInfo []byte) []byte {
+	if len(streamInfo) >= 8 && string(streamInfo[:4]) == "fLaC" {
+		streamInfo = streamInfo[8:]
+	}
+
+	if len(streamInfo) == 0 {
+		return nil
+	}
 
-			n, err = io.ReadFull(audioSocket, packet)
-			if err != nil {
-				break
+	return append([]byte{'f', 'L', 'a', 'C', 0x80, 0x00, 0x00, byte(len(streamInfo))}, streamInfo...)
+}
+
+func newAudioContainer(format string) *audioContainer {
+	return &audioContainer{
+		format:    format,
+		oggSerial: 0x73637079,
+	}
+}
+
+func (c *audioContainer) header() []byte {
+	if c.format == "wav" {
+		return audioWavHeader()
+	}
+
+	return nil
+}
+
+func (c *audioContainer) wrap(packet []byte) []byte {
+	payload := packet[12:]
+	var data []byte
+
+	switch c.format {
+	case "wav":
+		if !packetIsConfig(packet) {
+			data = payload
+		}
+	case "ogg":
+		if packetIsConfig(packet) {
+			if len(payload) < 19 || string(payload[:8]) != "OpusHead" {
+				return nil
 			}
-			if n != packetSize {
-				break
+
+			if c.oggStarted {
+				data = audioOggPage(0x04, c.oggGranule, c.oggSerial, c.oggSequence, nil)
+				c.oggSerial++
+				c.oggSequence = 0
 			}
 
-			n, err = w.Write(packet)
-			if err != nil {
-				connectionControlChannel <- false
-				break
+			tags := append([]byte("OpusTags"), 0x0F, 0x00, 0x00, 0x00)
+			tags = append(tags, "headless-scrcpy"...)
+			tags = append(tags, 0x00, 0x00, 0x00, 0x00)
+
+			data = append(data, audioOggPage(0x02, 0, c.oggSerial, 0, payload)...)
+			data = append(data, audioOggPage(0x00, 0, c.oggSerial, 1, tags)...)
+			c.oggSequence = 2
+			c.oggGranule = 0
+			c.oggStarted = true
+		} else if c.oggStarted {
+			c.oggGranule += audioOpusSamples(payload)
+			data = audioOggPage(0x00, c.oggGranule, c.oggSerial, c.oggSequence, payload)
+			c.oggSequence++
+		}
+	case "adts":
+		if packetIsConfig(packet) {
+			if len(payload) >= 2 {
+				c.audioSpecificConfig = payload
 			}
-			if n < packetSize {
-				connectionControlChannel <- false
-				break
+		} else if c.audioSpecificConfig != nil {
+			data = append(audioAdtsHeader(c.audioSpecificConfig, len(payload)), payload...)
+		}
+	case "flac":
+		if packetIsConfig(packet) {
+			if !c.flacStarted {
+				data = audioFlacHeader(payload)
+				c.flacStarted = data != nil
 			}
+		} else if c.flacStarted {
+			data = payload
+		}
+	}
+
+	return data
+}
+
+func audioSendContainerStream(w http.ResponseWriter, req *http.Request, format string) {
+	if !config.Scrcpy.Audio {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	packets := audioBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
+		return
+	}
+	defer audioBroadcaster.unsubscribe(packets)
+
+	if audioCodec != map[string]uint32{
+		"wav":  0x00726177,
+		"ogg":  0x6F707573,
+		"adts": 0x00616163,
+		"flac": 0x666C6163,
+	}[format] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec")
+	}
+
+	w.Header().Set("Content-Type", map[string]string{
+		"wav":  "audio/wav",
+		"ogg":  "audio/ogg",
+		"adts": "audio/aac",
+		"flac": "audio/flac",
+	}[format])
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Codec", strconv.FormatUint(uint64(audioCodec), 10))
 
-			w.(http.Flusher).Flush()
+	container := newAudioContainer(format)
+	data := container.header()
+	var n int
+	var err error
+
+	if len(data) > 0 {
+		n, err = w.Write(data)
+		if err != nil {
+			return
+		}
+		if n < len(data) {
+			return
+		}
+
+		w.(http.Flusher).Flush()
+	}
+
+	for packet := range packets {
+		data = container.wrap(packet)
+		if len(data) == 0 {
+			continue
+		}
+
+		n, err = w.Write(data)
+		if err != nil {
+			break
+		}
+		if n < len(data) {
+			break
 		}
+
+		w.(http.Flusher).Flush()
 	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const audioDecoderChunkSize = 3840
+
+var audioPcmBroadcaster = newPacketBroadcaster(false)
+var audioDecoderIsFfmpeg bool
+
+func audioDecoderFormat(codec uint32) string {
+	switch codec {
+	case 0x6F707573:
+		return "ogg"
+	case 0x00616163:
+		return "adts"
+	case 0x666C6163:
+		return "flac"
+	}
+
+	return ""
+}
+
+func audioDecoderCommand(format string) *exec.Cmd {
+	if audioDecoderIsFfmpeg {
+		demuxer := format
+		if format == "adts" {
+			demuxer = "aac"
+		}
+
+		return exec.Command(
+			config.AudioDecoder.Executable,
+			"-probesize", "32",
+			"-analyzeduration", "0",
+			"-f", demuxer,
+			"-i", "-",
+			"-f", "s16le",
+			"-ar", "48000",
+			"-ac", "2",
+			"-",
+		)
+	}
+
+	return exec.Command(
+		config.AudioDecoder.Executable,
+		strconv.FormatUint(uint64(audioCodec), 10),
+	)
+}
+
+func audioDecode() {
+	for {
+		packets := audioBroadcaster.subscribe(nil)
+
+		format := audioDecoderFormat(audioCodec)
+		if format == "" {
+			for range packets {
+			}
+
+			continue
+		}
+
+		if audioDecoderRun(packets, audioDecoderCommand(format), format) {
+			audioBroadcaster.unsubscribe(packets)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func audioDecoderRun(packets chan []byte, decoder *exec.Cmd, format string) bool {
+	decoder.Stderr = os.Stderr
+
+	decoderStdin, err := decoder.StdinPipe()
+	if err != nil {
+		return true
+	}
+
+	decoderStdout, err := decoder.StdoutPipe()
+	if err != nil {
+		return true
+	}
+
+	err = decoder.Start()
+	if err != nil {
+		return true
+	}
+
+	session := audioPcmBroadcaster.start()
+	exited := make(chan struct{})
+
+	go func() {
+		audioDecodeRead(decoderStdout, session)
+		close(exited)
+	}()
+
+	container := newAudioContainer(format)
+	var n int
+	var data []byte
+	crashed := false
+
+loop:
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				break loop
+			}
+
+			if audioDecoderIsFfmpeg {
+				data = container.wrap(packet)
+			} else {
+				data = packet
+			}
+
+			if len(data) == 0 {
+				continue
+			}
+
+			n, err = decoderStdin.Write(data)
+			if err != nil || n < len(data) {
+				crashed = true
+				break loop
+			}
+		case <-exited:
+			crashed = true
+			break loop
+		}
+	}
+
+	decoder.Process.Kill()
+	decoder.Wait()
+	<-exited
+
+	audioPcmBroadcaster.end(session)
+
+	return crashed
+}
+
+func audioDecodeRead(stdout io.Reader, session chan struct{}) {
+	var samples uint64
+	var n int
+	var err error
+	var packet []byte
+
+	for {
+		packet = make([]byte, 12+audioDecoderChunkSize)
+
+		n, err = io.ReadFull(stdout, packet[12:])
+		if err != nil {
+			break
+		}
+		if n != audioDecoderChunkSize {
+			break
+		}
+
+		binary.BigEndian.PutUint64(packet, samples*1000000/48000)
+		binary.BigEndian.PutUint32(packet[8:], audioDecoderChunkSize)
+		samples += audioDecoderChunkSize / 4
+
+		if !audioPcmBroadcaster.broadcast(session, packet) {
+			break
+		}
+	}
+}
+
+func audioSendPcmStream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Audio {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	broadcaster := audioBroadcaster
+
+	packets := broadcaster.subscribe(req.Context().Done())
+	if packets == nil {
+		return
+	}
+
+	if audioCodec != 0x00726177 {
+		broadcaster.unsubscribe(packets)
+
+		if !config.AudioDecoder.Enabled {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		broadcaster = audioPcmBroadcaster
+
+		packets = broadcaster.subscribe(req.Context().Done())
+		if packets == nil {
+			return
+		}
+	}
+	defer broadcaster.unsubscribe(packets)
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Sample-Format, Sample-Rate, Channels")
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Sample-Format", "s16le")
+	w.Header().Set("Sample-Rate", "48000")
+	w.Header().Set("Channels", "2")
+
+	var data []byte
+	var n int
+	var err error
+
+	for packet := range packets {
+		if packetIsConfig(packet) {
+			continue
+		}
+
+		data = packet[12:]
+
+		n, err = w.Write(data)
+		if err != nil {
+			break
+		}
+		if n < len(data) {
+			break
+		}
+
+		w.(http.Flusher).Flush()
+	}
+}
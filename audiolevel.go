@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const audioLevelWindow = 4800
+
+var audioLevelRms float64 = -100
+var audioLevelPeak float64 = -100
+var audioLevelSequence uint64
+var audioLevelAudible bool
+var audioLevelAudibleSequence uint64
+var audioLevelLast time.Time
+var audioLevelSilent bool = true
+var audioLevelUpdated chan struct{} = make(chan struct{})
+var audioLevelMutex sync.Mutex
+
+func audioLevelNotify() {
+	close(audioLevelUpdated)
+	audioLevelUpdated = make(chan struct{})
+}
+
+func audioLevelDecibels(value float64) float64 {
+	if value <= 0 {
+		return -100
+	}
+
+	return math.Max(20*math.Log10(value), -100)
+}
+
+func audioLevelUpdate(sumSquares float64, peak int, samples int) {
+	if samples == 0 {
+		return
+	}
+
+	rms := audioLevelDecibels(math.Sqrt(sumSquares/float64(samples)) / 32768)
+
+	audioLevelMutex.Lock()
+	defer audioLevelMutex.Unlock()
+
+	audioLevelRms = rms
+	audioLevelPeak = audioLevelDecibels(float64(peak) / 32768)
+	audioLevelSequence++
+	audioLevelAudible = rms > config.AudioLevel.Threshold
+
+	if audioLevelAudible {
+		if audioLevelSilent {
+			audioLevelAudibleSequence++
+		}
+
+		audioLevelLast = time.Now()
+		audioLevelSilent = false
+	}
+
+	audioLevelNotify()
+}
+
+func audioLevelMeasure(packets chan []byte) {
+	var sumSquares float64
+	var peak int
+	var samples int
+
+	for packet := range packets {
+		if packetIsConfig(packet) {
+			continue
+		}
+
+		payload := packet[12:]
+
+		for i := 0; i+1 < len(payload); i += 2 {
+			sample := int(int16(binary.LittleEndian.Uint16(payload[i:])))
+			if sample < 0 {
+				sample = -sample
+			}
+
+			sumSquares += float64(sample * sample)
+			if sample > peak {
+				peak = sample
+			}
+
+			samples++
+
+			if samples == audioLevelWindow*2 {
+				audioLevelUpdate(sumSquares, peak, samples)
+				sumSquares = 0
+				peak = 0
+				samples = 0
+			}
+		}
+	}
+}
+
+func audioLevelCollect() {
+	for {
+		packets := audioBroadcaster.subscribe(nil)
+
+		if audioCodec == 0x00726177 {
+			audioLevelMeasure(packets)
+		} else if config.AudioDecoder.Enabled {
+			audioBroadcaster.unsubscribe(packets)
+			audioLevelMeasure(audioPcmBroadcaster.subscribe(nil))
+		} else {
+			for range packets {
+			}
+		}
+	}
+}
+
+func audioLevelMonitor() {
+	silence := time.Duration(config.AudioLevel.Silence) * time.Millisecond
+
+	for {
+		audioLevelMutex.Lock()
+
+		updated := audioLevelUpdated
+		var timer <-chan time.Time
+
+		if !audioLevelSilent {
+			remaining := time.Until(audioLevelLast.Add(silence))
+
+			if remaining <= 0 {
+				audioLevelSilent = true
+				audioLevelNotify()
+				audioLevelMutex.Unlock()
+				continue
+			}
+
+			timer = time.After(remaining)
+		}
+
+		audioLevelMutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-timer:
+		}
+	}
+}
+
+func audioLevelWaitForAudio(timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	for {
+		audioLevelMutex.Lock()
+
+		if audioLevelSequence == 0 {
+			audioLevelMutex.Unlock()
+			return false
+		}
+
+		if audioLevelAudible {
+			audioLevelMutex.Unlock()
+			return true
+		}
+
+		updated := audioLevelUpdated
+
+		audioLevelMutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func audioLevelWaitForSilence(duration time.Duration, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	for {
+		audioLevelMutex.Lock()
+
+		if audioLevelSequence == 0 {
+			audioLevelMutex.Unlock()
+			return false
+		}
+
+		updated := audioLevelUpdated
+		remaining := time.Until(audioLevelLast.Add(duration))
+
+		audioLevelMutex.Unlock()
+
+		if remaining <= 0 {
+			return true
+		}
+
+		select {
+		case <-updated:
+		case <-time.After(remaining):
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func audioLevelSend(w http.ResponseWriter, req *http.Request) {
+	if !config.AudioLevel.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	audioLevelMutex.Lock()
+	rms := audioLevelRms
+	peak := audioLevelPeak
+	audible := audioLevelAudible
+	silent := audioLevelSilent
+	audioLevelMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"rms\":%.2f,\"peak\":%.2f,\"audible\":%t,\"silent\":%t}", rms, peak, audible, silent)
+}
+
+func audioLevelSendEventStream(w http.ResponseWriter, req *http.Request) {
+	if !config.AudioLevel.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	audioLevelMutex.Lock()
+	sequence := audioLevelSequence
+	audibleSequence := audioLevelAudibleSequence
+	silent := audioLevelSilent
+	audioLevelMutex.Unlock()
+
+	var err error
+
+	for {
+		audioLevelMutex.Lock()
+
+		var lines []string
+
+		if audioLevelAudibleSequence > audibleSequence {
+			audibleSequence = audioLevelAudibleSequence
+			silent = false
+			lines = append(lines, fmt.Sprintf("{\"event\":\"audio\",\"rms\":%.2f,\"peak\":%.2f}", audioLevelRms, audioLevelPeak))
+		}
+
+		if audioLevelSequence > sequence {
+			sequence = audioLevelSequence
+			lines = append(lines, fmt.Sprintf("{\"event\":\"level\",\"rms\":%.2f,\"peak\":%.2f}", audioLevelRms, audioLevelPeak))
+		}
+
+		if audioLevelSilent && !silent {
+			silent = true
+			lines = append(lines, fmt.Sprintf("{\"event\":\"silence\",\"duration\":%d}", time.Since(audioLevelLast).Milliseconds()))
+		}
+
+		updated := audioLevelUpdated
+
+		audioLevelMutex.Unlock()
+
+		for _, line := range lines {
+			_, err = fmt.Fprintln(w, line)
+			if err != nil {
+				return
+			}
+		}
+
+		if len(lines) > 0 {
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-updated:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const changeSignatureSize = 32
+
+var changeSignature []byte
+var changeSequence uint64
+var changeDifference float64
+var changeLast time.Time
+var changeIdle bool
+var changeUpdated chan struct{} = make(chan struct{})
+var changeMutex sync.Mutex
+
+func changeNotify() {
+	close(changeUpdated)
+	changeUpdated = make(chan struct{})
+}
+
+func changeUpdate(frame []byte, width int, height int) {
+	if width == 0 || height == 0 || len(frame) < videoPixelFormatSize(config.VideoDecoder.PixelFormat, width, height) {
+		return
+	}
+
+	signature := make([]byte, changeSignatureSize*changeSignatureSize)
+
+	for y := 0; y < changeSignatureSize; y++ {
+		for x := 0; x < changeSignatureSize; x++ {
+			r, g, b, _ := videoFramePixel(frame, config.VideoDecoder.PixelFormat, width, height, (2*x+1)*width/(2*changeSignatureSize), (2*y+1)*height/(2*changeSignatureSize))
+			signature[y*changeSignatureSize+x] = byte((19595*int(r) + 38470*int(g) + 7471*int(b) + 32768) >> 16)
+		}
+	}
+
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	difference := 255.0
+
+	if changeSignature != nil {
+		var sum int
+
+		for i := range signature {
+			d := int(signature[i]) - int(changeSignature[i])
+			if d < 0 {
+				d = -d
+			}
+
+			sum += d
+		}
+
+		difference = float64(sum) / float64(len(signature))
+	}
+
+	if changeSignature != nil && difference <= config.ChangeDetection.Threshold {
+		return
+	}
+
+	changeSignature = signature
+	changeSequence++
+	changeDifference = difference
+	changeLast = time.Now()
+	changeIdle = false
+	changeNotify()
+}
+
+func changeMonitor() {
+	idle := time.Duration(config.ChangeDetection.Idle) * time.Millisecond
+
+	for {
+		changeMutex.Lock()
+
+		updated := changeUpdated
+		var timer <-chan time.Time
+
+		if changeSignature != nil && !changeIdle {
+			remaining := time.Until(changeLast.Add(idle))
+
+			if remaining <= 0 {
+				changeIdle = true
+				changeNotify()
+				changeMutex.Unlock()
+				continue
+			}
+
+			timer = time.After(remaining)
+		}
+
+		changeMutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-timer:
+		}
+	}
+}
+
+func changeWaitForIdle(duration time.Duration, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	for {
+		changeMutex.Lock()
+
+		updated := changeUpdated
+		var timer <-chan time.Time
+
+		if changeSignature != nil {
+			remaining := time.Until(changeLast.Add(duration))
+
+			if remaining <= 0 {
+				changeMutex.Unlock()
+				return true
+			}
+
+			timer = time.After(remaining)
+		}
+
+		changeMutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-timer:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func changeWaitForChange(timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	changeMutex.Lock()
+	sequence := changeSequence
+	changeMutex.Unlock()
+
+	for {
+		changeMutex.Lock()
+
+		if changeSequence > sequence {
+			changeMutex.Unlock()
+			return true
+		}
+
+		updated := changeUpdated
+
+		changeMutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func changeSendEventStream(w http.ResponseWriter, req *http.Request) {
+	if !config.ChangeDetection.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	changeMutex.Lock()
+	sequence := changeSequence
+	idle := changeIdle
+	changeMutex.Unlock()
+
+	var err error
+
+	for {
+		changeMutex.Lock()
+
+		var lines []string
+
+		if changeSequence > sequence {
+			sequence = changeSequence
+			idle = false
+			lines = append(lines, fmt.Sprintf("{\"event\":\"change\",\"sequence\":%d,\"difference\":%.2f}", changeSequence, changeDifference))
+		}
+
+		if changeIdle && !idle {
+			idle = true
+			lines = append(lines, fmt.Sprintf("{\"event\":\"idle\",\"sequence\":%d,\"duration\":%d}", changeSequence, time.Since(changeLast).Milliseconds()))
+		}
+
+		updated := changeUpdated
+
+		changeMutex.Unlock()
+
+		for _, line := range lines {
+			_, err = fmt.Fprintln(w, line)
+			if err != nil {
+				return
+			}
+		}
+
+		if len(lines) > 0 {
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-updated:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
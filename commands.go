@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
@@ -13,19 +14,19 @@ import (
 	"time"
 )
 
-func commandsRun(commands [][]string) {
-	for _, command := range commands {
+func commandsRun(commands [][]string, results []string, strict bool) int {
+	for i, command := range commands {
 		if len(command) == 0 {
-			return
+			return i
 		}
 
 		if config.Scrcpy.Port < 1 {
 			if command[0] != "sleep" && command[0] != "adb" {
-				return
+				return i
 			}
 		} else if controlSocket == nil {
-			if command[0] != "connect" && command[0] != "startscrcpyserver" && command[0] != "sleep" && command[0] != "adb" && command[0] != "setconnectedcommands" {
-				return
+			if command[0] != "connect" && command[0] != "startscrcpyserver" && command[0] != "sleep" && command[0] != "adb" && command[0] != "setconnectedcommands" && command[0] != "startrecording" && command[0] != "stoprecording" && command[0] != "savereplay" && command[0] != "waitforimage" && command[0] != "waitforidle" && command[0] != "waitforchange" && command[0] != "waitforaudio" && command[0] != "waitforsilence" {
+				return i
 			}
 		}
 
@@ -35,28 +36,28 @@ func commandsRun(commands [][]string) {
 				select {
 				case connectionControlChannel <- true:
 				default:
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "disconnect":
 			if len(command) == 1 {
 				if scrcpyServer != nil {
-					return
+					return i
 				}
 
 				select {
 				case connectionControlChannel <- false:
 				default:
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "startscrcpyserver":
 			if !config.Adb.Enabled || !config.Scrcpy.Enabled {
-				return
+				return i
 			}
 
 			if scrcpyServer != nil {
@@ -133,12 +134,12 @@ func commandsRun(commands [][]string) {
 
 			if scrcpyServer.Start() != nil {
 				scrcpyServer = nil
-				return
+				return i
 			}
 		case "stopscrcpyserver":
 			if len(command) == 1 {
 				if scrcpyServer == nil {
-					return
+					return i
 				}
 
 				select {
@@ -151,47 +152,47 @@ func commandsRun(commands [][]string) {
 				scrcpyServer.Wait()
 				scrcpyServer = nil
 			} else {
-				return
+				return i
 			}
 		case "createuhiddevices":
 			if len(command) == 4 {
 				if command[1] != "" {
 					if !inputUhidCreateDevice(command[1], 0x01, "", "", "", controlSocket) {
-						return
+						return i
 					}
 				}
 
 				if command[2] != "" {
 					if !inputUhidCreateDevice(command[2], 0x02, "", "", "", controlSocket) {
-						return
+						return i
 					}
 				}
 
 				if command[3] != "" {
 					if !inputUhidCreateDevice(command[3], 0x03, "", "", "", controlSocket) {
-						return
+						return i
 					}
 				}
 			} else if len(command) == 13 {
 				if command[1] != "" {
 					if !inputUhidCreateDevice(command[1], 0x01, command[2], command[3], command[4], controlSocket) {
-						return
+						return i
 					}
 				}
 
 				if command[5] != "" {
 					if !inputUhidCreateDevice(command[5], 0x02, command[6], command[7], command[8], controlSocket) {
-						return
+						return i
 					}
 				}
 
 				if command[9] != "" {
 					if !inputUhidCreateDevice(command[9], 0x03, command[10], command[11], command[12], controlSocket) {
-						return
+						return i
 					}
 				}
 			} else {
-				return
+				return i
 			}
 		case "key", "key2":
 			if len(command) == 2 || len(command) == 5 {
@@ -201,80 +202,80 @@ func commandsRun(commands [][]string) {
 				if command[0] == "key" {
 					keycode = keycodeMap[command[1]]
 					if keycode == 0 {
-						return
+						return i
 					}
 				} else {
 					keycode, err = strconv.Atoi(command[1])
 					if err != nil {
-						return
+						return i
 					}
 				}
 
 				if len(command) == 2 {
 					if !inputSdkInjectKeycode(false, keycode, 0, 0) {
-						return
+						return i
 					}
 
 					if !inputSdkInjectKeycode(true, keycode, 0, 0) {
-						return
+						return i
 					}
 				} else {
 					up, err := strconv.ParseBool(command[2])
 					if err != nil {
-						return
+						return i
 					}
 
 					repeat, err := strconv.Atoi(command[3])
 					if err != nil {
-						return
+						return i
 					}
 
 					metaState, err := strconv.Atoi(command[4])
 					if err != nil {
-						return
+						return i
 					}
 
 					if !inputSdkInjectKeycode(up, keycode, repeat, metaState) {
-						return
+						return i
 					}
 				}
 			} else {
-				return
+				return i
 			}
 		case "key3":
 			if len(command) == 2 || len(command) == 3 {
 				scancode, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				if len(command) == 2 {
 					if !inputUhidKeyboardInput(scancode, 0) {
-						return
+						return i
 					}
 
 					if scancode != 0 {
 						if !inputUhidKeyboardInput(0, 0) {
-							return
+							return i
 						}
 					}
 				} else {
 					modifiers, err := strconv.Atoi(command[2])
 					if err != nil {
-						return
+						return i
 					}
 
 					if !inputUhidKeyboardInput(scancode, modifiers) {
-						return
+						return i
 					}
 				}
 			} else {
-				return
+				return i
 			}
 		case "type", "typebase64", "typebase64url", "typehex":
 			if len(command) == 2 {
 				if command[1] == "" {
-					return
+					return i
 				}
 
 				var text string
@@ -282,19 +283,19 @@ func commandsRun(commands [][]string) {
 				if command[0] == "typebase64" {
 					textBytes, err := base64.StdEncoding.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(textBytes)
 				} else if command[0] == "typebase64url" {
 					textBytes, err := base64.URLEncoding.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(textBytes)
 				} else if command[0] == "typehex" {
 					textBytes, err := hex.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(textBytes)
 				} else {
@@ -302,456 +303,456 @@ func commandsRun(commands [][]string) {
 				}
 
 				if !inputSdkInjectText(text) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "touch":
 			if len(command) == 5 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(0, -2, x, y, width, height, 1) {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(1, -2, x, y, width, height, 1) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "touchdown":
 			if len(command) == 5 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(0, -2, x, y, width, height, 1) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "touchup":
 			if len(command) == 5 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(1, -2, x, y, width, height, 1) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "touchmove":
 			if len(command) == 5 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(2, -2, x, y, width, height, 1) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "mouseclick":
 			if len(command) == 4 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputUhidMouseInput(inputGetMouseButton(command[1]), x, y, "") {
-					return
+					return i
 				}
 
 				if !inputUhidMouseInput(0, 0, 0, "") {
-					return
+					return i
 				}
 			} else if len(command) == 6 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[5])
 				if err != nil {
-					return
+					return i
 				}
 
 				button := inputGetMouseButton(command[1])
 
 				if !inputSdkInjectTouchEvent(0, -1, x, y, width, height, button) {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(1, -1, x, y, width, height, button) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "mousedown":
 			if len(command) == 4 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputUhidMouseInput(inputGetMouseButton(command[1]), x, y, "") {
-					return
+					return i
 				}
 			} else if len(command) == 6 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[5])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(0, -1, x, y, width, height, inputGetMouseButton(command[1])) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "mouseup":
 			if len(command) == 1 {
 				if !inputUhidMouseInput(0, 0, 0, "") {
-					return
+					return i
 				}
 			} else if len(command) == 6 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[5])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(1, -1, x, y, width, height, inputGetMouseButton(command[1])) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "mousemove":
 			if len(command) == 3 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputUhidMouseInput(0, x, y, "") {
-					return
+					return i
 				}
 			} else if len(command) == 4 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputUhidMouseInput(inputGetMouseButton(command[1]), x, y, "") {
-					return
+					return i
 				}
 			} else if len(command) == 6 {
 				x, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[5])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectTouchEvent(2, -1, x, y, width, height, inputGetMouseButton(command[1])) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "scrollleft", "scrollright", "scrollup", "scrolldown":
 			if len(command) == 1 && (command[0] == "scrollup" || command[0] == "scrolldown") {
 				if !inputUhidMouseInput(0, 0, 0, command[0][6:]) {
-					return
+					return i
 				}
 			} else if len(command) == 5 {
 				x, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				y, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				width, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				height, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputSdkInjectScrollEvent(x, y, width, height, command[0][6:]) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "gamepadinput":
 			if len(command) == 9 {
 				leftX, err := strconv.Atoi(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				leftY, err := strconv.Atoi(command[2])
 				if err != nil {
-					return
+					return i
 				}
 
 				rightX, err := strconv.Atoi(command[3])
 				if err != nil {
-					return
+					return i
 				}
 
 				rightY, err := strconv.Atoi(command[4])
 				if err != nil {
-					return
+					return i
 				}
 
 				leftTrigger, err := strconv.Atoi(command[5])
 				if err != nil {
-					return
+					return i
 				}
 
 				rightTrigger, err := strconv.Atoi(command[6])
 				if err != nil {
-					return
+					return i
 				}
 
 				buttons, err := strconv.Atoi(command[7])
 				if err != nil {
-					return
+					return i
 				}
 
 				dpad, err := strconv.Atoi(command[8])
 				if err != nil {
-					return
+					return i
 				}
 
 				if !inputUhidGamepadInput(leftX, leftY, rightX, rightY, leftTrigger, rightTrigger, buttons, dpad) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "openhardkeyboardsettings":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x0F})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "backorscreenon":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x04, 0x00, 0x04, 0x01})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 4 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "expandnotificationspanel":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x05})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "expandsettingspanel":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x06})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "collapsepanels":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x07})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "getclipboard", "getclipboardcut":
 			if len(command) == 1 {
 				if clipboardGet(command[0] == "getclipboardcut", nil, 0) != http.StatusNoContent {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "setclipboard", "setclipboardbase64", "setclipboardbase64url", "setclipboardhex", "setclipboardpaste", "setclipboardpastebase64", "setclipboardpastebase64url", "setclipboardpastehex":
 			if len(command) == 2 || len(command) == 3 || len(command) == 4 {
@@ -760,19 +761,19 @@ func commandsRun(commands [][]string) {
 				if strings.HasSuffix(command[0], "base64") {
 					decoded, err := base64.StdEncoding.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(decoded)
 				} else if strings.HasSuffix(command[0], "base64url") {
 					decoded, err := base64.URLEncoding.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(decoded)
 				} else if strings.HasSuffix(command[0], "hex") {
 					decoded, err := hex.DecodeString(command[1])
 					if err != nil {
-						return
+						return i
 					}
 					text = string(decoded)
 				} else {
@@ -789,52 +790,52 @@ func commandsRun(commands [][]string) {
 					if len(command) == 4 {
 						timeout, err = time.ParseDuration(command[3])
 						if err != nil {
-							return
+							return i
 						}
 					}
 				}
 
 				if !clipboardSet(text, sequenceString, strings.HasPrefix(command[0], "setclipboardpaste"), timeout) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "turnscreenon":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x0A, 0x02})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 2 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "turnscreenoff":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x0A, 0x00})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 2 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "rotate":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x0B})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "startapp":
 			if len(command) == 2 {
@@ -845,56 +846,221 @@ func commandsRun(commands [][]string) {
 
 				n, err := controlSocket.Write(data)
 				if err != nil {
-					return
+					return i
 				}
 				if n != len(data) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "resetvideo":
 			if len(command) == 1 {
 				n, err := controlSocket.Write([]byte{0x11})
 				if err != nil {
-					return
+					return i
 				}
 				if n != 1 {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "senddata":
 			if len(command) == 2 {
 				data, err := hex.DecodeString(command[1])
 				if err != nil {
-					return
+					return i
 				}
 				if len(data) == 0 {
-					return
+					return i
 				}
 
 				n, err := controlSocket.Write(data)
 				if err != nil {
-					return
+					return i
 				}
 				if n != len(data) {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
+			}
+		case "startrecording":
+			if len(command) == 2 {
+				if !recordStart(command[1]) {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "stoprecording":
+			if len(command) == 1 {
+				if !recordStop() {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "savereplay":
+			if len(command) == 2 || len(command) == 3 {
+				var duration time.Duration
+				var err error
+
+				if len(command) == 3 {
+					duration, err = time.ParseDuration(command[2])
+					if err != nil {
+						return i
+					}
+				}
+
+				if !replaySave(command[1], duration) {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "waitforimage":
+			if len(command) >= 2 && len(command) <= 5 {
+				timeout := time.Duration(-1)
+				var toleranceString string
+				var regionString string
+				var err error
+
+				if len(command) > 2 && command[2] != "" {
+					timeout, err = time.ParseDuration(command[2])
+					if err != nil {
+						return i
+					}
+				}
+
+				if len(command) > 3 {
+					toleranceString = command[3]
+				}
+
+				if len(command) > 4 {
+					regionString = command[4]
+				}
+
+				data, err := os.ReadFile(command[1])
+				if err != nil {
+					return i
+				}
+
+				template, tolerance, region, ok := matchParse(data, toleranceString, regionString)
+				if !ok {
+					return i
+				}
+
+				match, score, ok := matchWait(template, region, tolerance, timeout, nil)
+				if !ok {
+					return i
+				}
+
+				if results != nil {
+					results[i] = matchFormat(match, score)
+				}
+			} else {
+				return i
+			}
+		case "waitforidle":
+			if config.ChangeDetection.Enabled && len(command) <= 3 {
+				duration := time.Duration(config.ChangeDetection.Idle) * time.Millisecond
+				var timeout time.Duration
+				var err error
+
+				if len(command) > 1 && command[1] != "" {
+					duration, err = time.ParseDuration(command[1])
+					if err != nil {
+						return i
+					}
+				}
+
+				if len(command) > 2 {
+					timeout, err = time.ParseDuration(command[2])
+					if err != nil {
+						return i
+					}
+				}
+
+				if !changeWaitForIdle(duration, timeout) {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "waitforchange":
+			if config.ChangeDetection.Enabled && len(command) <= 2 {
+				var timeout time.Duration
+				var err error
+
+				if len(command) > 1 {
+					timeout, err = time.ParseDuration(command[1])
+					if err != nil {
+						return i
+					}
+				}
+
+				if !changeWaitForChange(timeout) {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "waitforaudio":
+			if config.AudioLevel.Enabled && len(command) <= 2 {
+				var timeout time.Duration
+				var err error
+
+				if len(command) > 1 {
+					timeout, err = time.ParseDuration(command[1])
+					if err != nil {
+						return i
+					}
+				}
+
+				if !audioLevelWaitForAudio(timeout) {
+					return i
+				}
+			} else {
+				return i
+			}
+		case "waitforsilence":
+			if config.AudioLevel.Enabled && len(command) <= 3 {
+				duration := time.Duration(config.AudioLevel.Silence) * time.Millisecond
+				var timeout time.Duration
+				var err error
+
+				if len(command) > 1 && command[1] != "" {
+					duration, err = time.ParseDuration(command[1])
+					if err != nil {
+						return i
+					}
+				}
+
+				if len(command) > 2 {
+					timeout, err = time.ParseDuration(command[2])
+					if err != nil {
+						return i
+					}
+				}
+
+				if !audioLevelWaitForSilence(duration, timeout) {
+					return i
+				}
+			} else {
+				return i
 			}
 		case "sleep":
 			if len(command) == 2 {
 				duration, err := time.ParseDuration(command[1])
 				if err != nil {
-					return
+					return i
 				}
 
 				time.Sleep(duration)
 			} else {
-				return
+				return i
 			}
 		case "adb":
 			if len(command) == 2 && config.Adb.Enabled && config.Adb.Executable != "" && (command[1] == "connect" || command[1] == "disconnect") {
@@ -905,7 +1071,7 @@ func commandsRun(commands [][]string) {
 				cmd.Stderr = os.Stderr
 
 				if cmd.Run() != nil {
-					return
+					return i
 				}
 			} else if len(command) > 1 && config.Adb.Enabled && config.Adb.Executable != "" {
 				var args []string
@@ -924,10 +1090,10 @@ func commandsRun(commands [][]string) {
 				cmd.Stderr = os.Stderr
 
 				if cmd.Run() != nil {
-					return
+					return i
 				}
 			} else {
-				return
+				return i
 			}
 		case "setconnectedcommands":
 			if len(command) == 2 {
@@ -935,8 +1101,75 @@ func commandsRun(commands [][]string) {
 					json.Unmarshal([]byte(commands), &scrcpyConnectedCommands)
 				}(command[1])
 			} else {
-				return
+				return i
 			}
+		default:
+			if strict {
+				return i
+			}
+		}
+	}
+
+	return len(commands)
+}
+
+func commandsResults(commands [][]string, outputs []string, completed int) ([]byte, error) {
+	type result struct {
+		Command []string        `json:"command"`
+		Status  string          `json:"status"`
+		Result  json.RawMessage `json:"result,omitempty"`
+	}
+
+	results := make([]result, len(commands))
+
+	for i, command := range commands {
+		results[i].Command = command
+
+		if outputs[i] != "" {
+			results[i].Result = json.RawMessage(outputs[i])
+		}
+
+		if i < completed {
+			results[i].Status = "ok"
+		} else if i == completed {
+			results[i].Status = "failed"
+		} else {
+			results[i].Status = "skipped"
 		}
 	}
+
+	return json.Marshal(results)
+}
+
+func commandsSendBatch(w http.ResponseWriter, req *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var commands [][]string
+
+	err = json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&commands)
+	if err != nil || len(commands) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	outputs := make([]string, len(commands))
+	completed := commandsRun(commands, outputs, true)
+
+	data, err := commandsResults(commands, outputs, completed)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if completed < len(commands) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	w.Write(data)
 }
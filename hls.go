@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type hlsSegment struct {
+	sequence      int
+	init          int
+	discontinuity bool
+	duration      float64
+	data          []byte
+}
+
+var hlsInits map[int][]byte = make(map[int][]byte)
+var hlsSegments []*hlsSegment
+var hlsNextSequence int
+var hlsDiscontinuitySequence int
+var hlsMutex sync.RWMutex
+
+func hlsAddSegment(init int, discontinuity bool, duration float64, data []byte) {
+	hlsMutex.Lock()
+	defer hlsMutex.Unlock()
+
+	hlsSegments = append(hlsSegments, &hlsSegment{
+		sequence:      hlsNextSequence,
+		init:          init,
+		discontinuity: discontinuity,
+		duration:      duration,
+		data:          data,
+	})
+
+	hlsNextSequence++
+
+	for len(hlsSegments) > config.Hls.Window+2 {
+		if hlsSegments[0].discontinuity {
+			hlsDiscontinuitySequence++
+		}
+
+		hlsSegments = hlsSegments[1:]
+	}
+
+	for id := range hlsInits {
+		if id < hlsSegments[0].init {
+			delete(hlsInits, id)
+		}
+	}
+}
+
+func hlsSegmenter() {
+	var initId int
+	targetDuration := uint64(config.Hls.SegmentDuration) * 1000
+
+	for {
+		packets := videoBroadcaster.subscribe(nil)
+
+		var muxer *mp4Muxer
+		var track *mp4Track
+		var segment []byte
+		var segmentPts uint64
+		var segmentStarted bool
+		var discontinuity bool
+
+		for packet := range packets {
+			if packetIsConfig(packet) {
+				muxer = newMp4Muxer(false)
+				width, height, ok := videoConfigSize(videoCodec, packet[12:])
+				if !ok {
+					width = initialVideoWidth
+					height = initialVideoHeight
+				}
+
+				track = muxer.addVideoTrack(videoCodec, width, height)
+				muxer.push(track, packet)
+
+				init := muxer.initSegment()
+				if init == nil {
+					muxer = nil
+					continue
+				}
+
+				muxer.initialized = true
+				initId++
+
+				hlsMutex.Lock()
+				hlsInits[initId] = init
+				discontinuity = len(hlsSegments) > 0
+				hlsMutex.Unlock()
+
+				segment = nil
+				segmentStarted = false
+				continue
+			}
+
+			if muxer == nil {
+				continue
+			}
+
+			keyframe := packetIsKeyframe(packet)
+			pts := packetPts(packet)
+
+			if segmentStarted && keyframe && pts >= segmentPts+targetDuration {
+				segment = append(segment, muxer.push(track, packet)...)
+				hlsAddSegment(initId, discontinuity, float64(pts-segmentPts)/1000000, segment)
+
+				discontinuity = false
+				segment = nil
+				segmentPts = pts
+				continue
+			}
+
+			if !segmentStarted && keyframe {
+				segmentStarted = true
+				segmentPts = pts
+			}
+
+			segment = append(segment, muxer.push(track, packet)...)
+		}
+	}
+}
+
+func hlsSend(w http.ResponseWriter, req *http.Request) {
+	if !config.Hls.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	hlsMutex.RLock()
+	defer hlsMutex.RUnlock()
+
+	if query.Get("init") != "" {
+		id, err := strconv.Atoi(query.Get("init"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		init, ok := hlsInits[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(init)
+		return
+	}
+
+	if query.Get("segment") != "" {
+		sequence, err := strconv.Atoi(query.Get("segment"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, segment := range hlsSegments {
+			if segment.sequence == sequence {
+				w.Header().Set("Content-Type", "video/iso.segment")
+				w.Write(segment.data)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(hlsSegments) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	start := len(hlsSegments) - config.Hls.Window
+	if start < 0 {
+		start = 0
+	}
+
+	discontinuitySequence := hlsDiscontinuitySequence
+	for _, segment := range hlsSegments[:start+1] {
+		if segment.discontinuity {
+			discontinuitySequence++
+		}
+	}
+
+	targetDuration := 1.0
+	for _, segment := range hlsSegments[start:] {
+		if segment.duration > targetDuration {
+			targetDuration = segment.duration
+		}
+	}
+
+	name := path.Base(req.URL.Path)
+
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", hlsSegments[start].sequence)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+
+	init := -1
+
+	for i, segment := range hlsSegments[start:] {
+		if segment.discontinuity && i > 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		if segment.init != init {
+			init = segment.init
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s?init=%d\"\n", name, init)
+		}
+
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s?segment=%d\n", segment.duration, name, segment.sequence)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(b.String()))
+}
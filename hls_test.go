@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+var hlsTestSegmenter sync.Once
+
+func hlsTestWait(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHlsSegmenterSize(t *testing.T) {
+	config.Hls.SegmentDuration = 1000
+	config.Hls.Window = 10
+	videoCodec = 0x68323634
+	initialVideoWidth = 640
+	initialVideoHeight = 480
+
+	pps := []byte{0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80}
+	landscape := append(append([]byte{0, 0, 0, 1}, h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 150, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}, vui: true})...), pps...)
+	portrait := append(append([]byte{0, 0, 0, 1}, h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 68, heightInMapUnit: 150, frameMbsOnly: true, crop: []uint64{0, 4, 0, 0}, vui: true})...), pps...)
+
+	hlsMutex.Lock()
+	hlsInits = make(map[int][]byte)
+	hlsSegments = nil
+	hlsMutex.Unlock()
+
+	session := videoBroadcaster.start()
+	defer videoBroadcaster.end(session)
+
+	videoBroadcaster.broadcast(session, packetTest(true, false, 0, landscape))
+
+	hlsTestSegmenter.Do(func() {
+		go hlsSegmenter()
+	})
+
+	hlsTestWait(t, func() bool {
+		videoBroadcaster.mutex.Lock()
+		defer videoBroadcaster.mutex.Unlock()
+
+		return len(videoBroadcaster.subscribers) > 0
+	})
+
+	tests := []struct {
+		name          string
+		config        []byte
+		width         int
+		height        int
+		discontinuity bool
+	}{
+		{"landscape", nil, 2400, 1080, false},
+		{"portrait", portrait, 1080, 2400, true},
+		{"landscape again", landscape, 2400, 1080, true},
+	}
+
+	var pts uint64
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hlsMutex.RLock()
+			segments := len(hlsSegments)
+			hlsMutex.RUnlock()
+
+			if test.config != nil {
+				videoBroadcaster.broadcast(session, packetTest(true, false, pts, test.config))
+			}
+
+			for i := 0; i < 3; i++ {
+				videoBroadcaster.broadcast(session, packetTest(false, true, pts, []byte{0, 0, 0, 1, 0x65, 0x88, byte(i)}))
+				videoBroadcaster.broadcast(session, packetTest(false, false, pts+500000, []byte{0, 0, 0, 1, 0x41, 0x9A, byte(i)}))
+				pts += 1000000
+			}
+
+			hlsTestWait(t, func() bool {
+				hlsMutex.RLock()
+				defer hlsMutex.RUnlock()
+
+				return len(hlsSegments) >= segments+2
+			})
+
+			hlsMutex.RLock()
+			defer hlsMutex.RUnlock()
+
+			segment := hlsSegments[segments]
+			if segment.discontinuity != test.discontinuity {
+				t.Errorf("discontinuity %v, want %v", segment.discontinuity, test.discontinuity)
+			}
+
+			if segment.duration != 1 {
+				t.Errorf("duration %v, want 1", segment.duration)
+			}
+
+			boxes := mp4TestBoxes(t, "", hlsInits[segment.init])
+
+			tkhd := mp4TestFind(boxes, "/moov/trak/tkhd")
+			if width, height := int(binary.BigEndian.Uint32(tkhd[76:])>>16), int(binary.BigEndian.Uint32(tkhd[80:])>>16); width != test.width || height != test.height {
+				t.Errorf("tkhd %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+
+			sampleEntry := mp4TestFind(boxes, "/moov/trak/mdia/minf/stbl/stsd/avc1")
+			if width, height := int(binary.BigEndian.Uint16(sampleEntry[24:])), int(binary.BigEndian.Uint16(sampleEntry[26:])); width != test.width || height != test.height {
+				t.Errorf("sample entry %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+
+			for _, segment := range hlsSegments[segments : segments+2] {
+				mp4TestBoxes(t, "", segment.data)
+			}
+		})
+	}
+}
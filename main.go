@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -24,6 +25,8 @@ type Endpoint struct {
 	Response         string     `json:"response"`
 	ClipboardCut     bool       `json:"clipboardCut"`
 	ClipboardTimeout int        `json:"clipboardTimeout"`
+	Batch            bool       `json:"batch"`
+	Template         string     `json:"template"`
 }
 
 type Config struct {
@@ -34,6 +37,7 @@ type Config struct {
 		Cert      string              `json:"cert"`
 		Key       string              `json:"key"`
 		Endpoints map[string]Endpoint `json:"endpoints"`
+		Origins   []string            `json:"origins"`
 	} `json:"httpServer"`
 
 	StdinCommands struct {
@@ -78,11 +82,41 @@ type Config struct {
 	} `json:"scrcpy"`
 
 	VideoDecoder struct {
+		Enabled     bool   `json:"enabled"`
+		Executable  string `json:"executable"`
+		Stream      bool   `json:"stream"`
+		Alpha       bool   `json:"alpha"`
+		PixelFormat string `json:"pixelFormat"`
+		InProcess   bool   `json:"inProcess"`
+	} `json:"videoDecoder"`
+
+	AudioDecoder struct {
 		Enabled    bool   `json:"enabled"`
 		Executable string `json:"executable"`
-		Stream     bool   `json:"stream"`
-		Alpha      bool   `json:"alpha"`
-	} `json:"videoDecoder"`
+	} `json:"audioDecoder"`
+
+	Replay struct {
+		Enabled  bool `json:"enabled"`
+		Duration int  `json:"duration"`
+	} `json:"replay"`
+
+	ChangeDetection struct {
+		Enabled   bool    `json:"enabled"`
+		Threshold float64 `json:"threshold"`
+		Idle      int     `json:"idle"`
+	} `json:"changeDetection"`
+
+	AudioLevel struct {
+		Enabled   bool    `json:"enabled"`
+		Threshold float64 `json:"threshold"`
+		Silence   int     `json:"silence"`
+	} `json:"audioLevel"`
+
+	Hls struct {
+		Enabled         bool `json:"enabled"`
+		SegmentDuration int  `json:"segmentDuration"`
+		Window          int  `json:"window"`
+	} `json:"hls"`
 }
 
 var stdinDecoder *json.Decoder
@@ -92,8 +126,6 @@ var videoSocket net.Conn
 var audioSocket net.Conn
 var controlSocket net.Conn
 var connectionControlChannel chan bool = make(chan bool)
-var videoConnectedChannel chan struct{} = make(chan struct{})
-var audioConnectedChannel chan struct{} = make(chan struct{})
 var clipboardChannel chan string = make(chan string)
 var uhidKeyboardOutputChannel chan string = make(chan string)
 var deviceName string
@@ -104,10 +136,21 @@ var initialVideoHeight int
 var scrcpyServer *exec.Cmd
 var scrcpyConnectedCommands [][]string
 var videoDecoderIsFfmpeg bool
+var videoDecoderIsCgo bool
 var videoFrame []byte
 var videoFrameWidth int
 var videoFrameHeight int
 var videoFrameMutex sync.RWMutex
+var videoFrameSequence uint64
+var videoFramePts uint64
+var videoFrameUpdated chan struct{} = make(chan struct{})
+var videoPixelFormats map[string]string = map[string]string{
+	"rgb24":   "rgb24",
+	"rgba":    "rgba",
+	"bgra":    "bgra",
+	"gray8":   "gray",
+	"yuv420p": "yuv420p",
+}
 
 func list(serverArg string) (string, int) {
 	if !config.Adb.Enabled || !config.Scrcpy.Enabled || config.Scrcpy.Server == "" || config.Scrcpy.ServerVersion == "" {
@@ -188,35 +231,66 @@ func readDeviceMeta() bool {
 	return true
 }
 
+func originAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range config.HttpServer.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return u.Host == req.Host
+}
+
 func endpointHandler(w http.ResponseWriter, req *http.Request) {
 	origin := req.Header.Get("Origin")
+	endpoint := config.HttpServer.Endpoints[req.URL.Path]
+
+	method := http.MethodGet
+	if endpoint.Batch || (endpoint.Response == "videoMatch" && endpoint.Template == "") {
+		method = http.MethodPost
+	}
+
+	if method == http.MethodPost && !originAllowed(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	w.Header().Set("Cache-Control", "no-store")
 
 	switch req.Method {
 	case http.MethodOptions:
 		if req.Header.Get("Access-Control-Request-Method") == "" {
-			w.Header().Set("Allow", "OPTIONS, GET")
+			w.Header().Set("Allow", "OPTIONS, "+method)
 		} else if origin != "" {
 			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
 
 			w.Header().Set("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.Header().Set("Access-Control-Allow-Methods", method)
 
 			if requestHeaders != "" {
 				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
 			}
 		}
-	case http.MethodGet:
+	case method:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		endpoint := config.HttpServer.Endpoints[req.URL.Path]
-
-		if len(endpoint.Commands) > 0 {
+		if endpoint.Batch {
+			commandsSendBatch(w, req)
+		} else if len(endpoint.Commands) > 0 {
 			query := req.URL.Query()
 			commands := make([][]string, len(endpoint.Commands))
 			for i := range endpoint.Commands {
@@ -226,7 +300,7 @@ func endpointHandler(w http.ResponseWriter, req *http.Request) {
 				}
 			}
 
-			go commandsRun(commands)
+			go commandsRun(commands, nil, false)
 			w.WriteHeader(http.StatusNoContent)
 		} else {
 			switch endpoint.Response {
@@ -234,8 +308,12 @@ func endpointHandler(w http.ResponseWriter, req *http.Request) {
 				videoSendStream(w, req, true)
 			case "rawVideoStream":
 				videoSendStream(w, req, false)
+			case "mp4VideoStream":
+				videoSendMp4Stream(w, req)
 			case "rgbVideoStream":
-				if videoDecoderIsFfmpeg {
+				if videoDecoderIsCgo {
+					videoSendCgoRgbStream(w, req)
+				} else if videoDecoderIsFfmpeg {
 					videoSendFfmpegRgbStream(w, req)
 				} else {
 					videoSendRgbStream(w, req)
@@ -244,6 +322,20 @@ func endpointHandler(w http.ResponseWriter, req *http.Request) {
 				audioSendStream(w, req, true)
 			case "rawAudioStream":
 				audioSendStream(w, req, false)
+			case "wavAudioStream":
+				audioSendContainerStream(w, req, "wav")
+			case "oggAudioStream":
+				audioSendContainerStream(w, req, "ogg")
+			case "adtsAudioStream":
+				audioSendContainerStream(w, req, "adts")
+			case "flacAudioStream":
+				audioSendContainerStream(w, req, "flac")
+			case "pcmAudioStream":
+				audioSendPcmStream(w, req)
+			case "mkvStream":
+				mkvSendStream(w, req)
+			case "webSocket":
+				webSocketHandle(w, req)
 			case "clipboardStream":
 				clipboardSendStream(w, req)
 			case "uhidKeyboardOutputStream":
@@ -293,8 +385,32 @@ func endpointHandler(w http.ResponseWriter, req *http.Request) {
 				} else {
 					w.Write([]byte(strconv.Itoa(initialVideoHeight)))
 				}
+			case "videoSize":
+				videoSizeSend(w, req)
+			case "videoSizeStream":
+				videoSizeSendStream(w, req)
 			case "videoFrame":
 				videoSendFrame(w, req)
+			case "videoDecoderHealth":
+				videoDecoderSendHealth(w, req)
+			case "videoPixels":
+				videoSendPixels(w, req)
+			case "videoMatch":
+				matchSend(w, req, endpoint.Template)
+			case "changeEventStream":
+				changeSendEventStream(w, req)
+			case "audioLevel":
+				audioLevelSend(w, req)
+			case "audioLevelEventStream":
+				audioLevelSendEventStream(w, req)
+			case "mjpegVideoStream":
+				videoSendMjpegStream(w, req)
+			case "videoSnapshot":
+				videoSendSnapshot(w, req)
+			case "replay":
+				replaySend(w, req)
+			case "hls":
+				hlsSend(w, req)
 			case "encoders", "displays", "cameras", "apps":
 				output, status := list(fmt.Sprintf("list_%s=true", endpoint.Response))
 
@@ -323,7 +439,7 @@ func endpointHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		w.Header().Set("Allow", "OPTIONS, GET")
+		w.Header().Set("Allow", "OPTIONS, "+method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -381,7 +497,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	if config.VideoDecoder.Enabled && (!config.Scrcpy.Enabled || config.VideoDecoder.Executable == "") {
+	videoDecoderIsCgo = config.VideoDecoder.InProcess && videoCgoDecoderAvailable
+
+	if config.VideoDecoder.Enabled && (!config.Scrcpy.Enabled || (config.VideoDecoder.Executable == "" && !videoDecoderIsCgo)) {
+		os.Exit(1)
+	}
+
+	if config.VideoDecoder.PixelFormat == "" {
+		if config.VideoDecoder.Alpha {
+			config.VideoDecoder.PixelFormat = "rgba"
+		} else {
+			config.VideoDecoder.PixelFormat = "rgb24"
+		}
+	}
+
+	if _, ok := videoPixelFormats[config.VideoDecoder.PixelFormat]; !ok {
+		os.Exit(1)
+	}
+
+	if config.AudioDecoder.Enabled && (!config.Scrcpy.Enabled || !config.Scrcpy.Audio || config.AudioDecoder.Executable == "") {
+		os.Exit(1)
+	}
+
+	if config.ChangeDetection.Enabled && (!config.VideoDecoder.Enabled || config.VideoDecoder.Stream || config.ChangeDetection.Threshold < 0 || config.ChangeDetection.Idle < 1) {
+		os.Exit(1)
+	}
+
+	if config.AudioLevel.Threshold == 0 {
+		config.AudioLevel.Threshold = -50
+	}
+
+	if config.AudioLevel.Enabled && (!config.Scrcpy.Enabled || !config.Scrcpy.Audio || config.AudioLevel.Threshold >= 0 || config.AudioLevel.Silence < 1) {
+		os.Exit(1)
+	}
+
+	if config.AudioLevel.Enabled && !config.AudioDecoder.Enabled {
+		raw := false
+		for _, option := range config.Scrcpy.ServerOptions {
+			if option == "audio_codec=raw" {
+				raw = true
+			}
+		}
+
+		if !raw {
+			os.Exit(1)
+		}
+	}
+
+	if config.Replay.Enabled && (!config.Scrcpy.Enabled || config.Replay.Duration < 1) {
+		os.Exit(1)
+	}
+
+	if config.Hls.Enabled && (!config.Scrcpy.Enabled || !config.HttpServer.Enabled || config.Hls.SegmentDuration < 1 || config.Hls.Window < 1) {
 		os.Exit(1)
 	}
 
@@ -393,18 +560,60 @@ func main() {
 		scrcpyConnectedCommands = config.Scrcpy.ConnectedCommands
 
 		if config.Scrcpy.Video && config.VideoDecoder.Enabled && !config.VideoDecoder.Stream {
-			if runtime.GOOS == "windows" {
-				videoDecoderIsFfmpeg = true
+			if videoDecoderIsCgo {
+				go videoDecodeCgo()
 			} else {
-				_, ok := exec.Command(config.VideoDecoder.Executable).Run().(*exec.ExitError)
-				videoDecoderIsFfmpeg = ok
+				if runtime.GOOS == "windows" {
+					videoDecoderIsFfmpeg = true
+				} else {
+					_, ok := exec.Command(config.VideoDecoder.Executable).Run().(*exec.ExitError)
+					videoDecoderIsFfmpeg = ok
+				}
+
+				if videoDecoderIsFfmpeg {
+					go videoDecodeFfmpeg()
+				} else {
+					go videoDecode()
+				}
 			}
 
-			if videoDecoderIsFfmpeg {
-				go videoDecodeFfmpeg()
+			if config.ChangeDetection.Enabled {
+				go changeMonitor()
+			}
+		}
+
+		if config.Scrcpy.Video {
+			go videoSizeTrack()
+		}
+
+		if config.AudioDecoder.Enabled {
+			if runtime.GOOS == "windows" {
+				audioDecoderIsFfmpeg = true
 			} else {
-				go videoDecode()
+				_, ok := exec.Command(config.AudioDecoder.Executable).Run().(*exec.ExitError)
+				audioDecoderIsFfmpeg = ok
 			}
+
+			go audioDecode()
+		}
+
+		if config.AudioLevel.Enabled {
+			go audioLevelCollect()
+			go audioLevelMonitor()
+		}
+
+		if config.Replay.Enabled {
+			if config.Scrcpy.Video {
+				go replayCollect(videoBroadcaster, true)
+			}
+
+			if config.Scrcpy.Audio {
+				go replayCollect(audioBroadcaster, false)
+			}
+		}
+
+		if config.Hls.Enabled && config.Scrcpy.Video {
+			go hlsSegmenter()
 		}
 
 		go func() {
@@ -608,6 +817,8 @@ func main() {
 									if config.Scrcpy.StdoutClipboard {
 										fmt.Println(string(lineBytes))
 									} else if config.HttpServer.Enabled {
+										webSocketClipboardBroadcaster.publish(string(lineBytes))
+
 										go func(line string) {
 											clipboardChannel <- line
 										}(string(lineBytes))
@@ -624,6 +835,8 @@ func main() {
 									if config.Scrcpy.StdoutClipboard {
 										fmt.Println(strconv.FormatUint(binary.BigEndian.Uint64(data[:8]), 10))
 									} else if config.HttpServer.Enabled {
+										webSocketClipboardBroadcaster.publish(strconv.FormatUint(binary.BigEndian.Uint64(data[:8]), 10))
+
 										go func(line string) {
 											clipboardChannel <- line
 										}(strconv.FormatUint(binary.BigEndian.Uint64(data[:8]), 10))
@@ -651,6 +864,8 @@ func main() {
 										if config.Scrcpy.StdoutUhidKeyboardOutput {
 											fmt.Println(hex.EncodeToString(data[:size]))
 										} else if config.HttpServer.Enabled {
+											webSocketUhidKeyboardOutputBroadcaster.publish(hex.EncodeToString(data[:size]))
+
 											select {
 											case uhidKeyboardOutputChannel <- hex.EncodeToString(data[:size]):
 											default:
@@ -663,15 +878,15 @@ func main() {
 					}
 
 					if config.Scrcpy.Video {
-						videoConnectedChannel <- struct{}{}
+						go videoBroadcaster.run(videoSocket)
 					}
 
 					if config.Scrcpy.Audio {
-						audioConnectedChannel <- struct{}{}
+						go audioBroadcaster.run(audioSocket)
 					}
 
 					if len(scrcpyConnectedCommands) > 0 {
-						go commandsRun(scrcpyConnectedCommands)
+						go commandsRun(scrcpyConnectedCommands, nil, false)
 					}
 				} else {
 					if videoSocket != nil {
@@ -702,7 +917,11 @@ func main() {
 				os.Exit(1)
 			}
 
-			if endpoint.Response != "" && endpoint.Response != "videoStream" && endpoint.Response != "rawVideoStream" && endpoint.Response != "rgbVideoStream" && endpoint.Response != "audioStream" && endpoint.Response != "rawAudioStream" && endpoint.Response != "clipboardStream" && endpoint.Response != "uhidKeyboardOutputStream" && endpoint.Response != "clipboard" && endpoint.Response != "deviceName" && endpoint.Response != "videoCodec" && endpoint.Response != "audioCodec" && endpoint.Response != "initialVideoWidth" && endpoint.Response != "initialVideoHeight" && endpoint.Response != "videoFrame" && endpoint.Response != "encoders" && endpoint.Response != "displays" && endpoint.Response != "cameras" && endpoint.Response != "cameraSizes" && endpoint.Response != "apps" {
+			if endpoint.Batch && (len(endpoint.Commands) > 0 || endpoint.Response != "") {
+				os.Exit(1)
+			}
+
+			if endpoint.Response != "" && endpoint.Response != "videoStream" && endpoint.Response != "rawVideoStream" && endpoint.Response != "mp4VideoStream" && endpoint.Response != "rgbVideoStream" && endpoint.Response != "audioStream" && endpoint.Response != "rawAudioStream" && endpoint.Response != "wavAudioStream" && endpoint.Response != "oggAudioStream" && endpoint.Response != "adtsAudioStream" && endpoint.Response != "flacAudioStream" && endpoint.Response != "pcmAudioStream" && endpoint.Response != "mkvStream" && endpoint.Response != "clipboardStream" && endpoint.Response != "uhidKeyboardOutputStream" && endpoint.Response != "clipboard" && endpoint.Response != "deviceName" && endpoint.Response != "videoCodec" && endpoint.Response != "audioCodec" && endpoint.Response != "initialVideoWidth" && endpoint.Response != "initialVideoHeight" && endpoint.Response != "videoSize" && endpoint.Response != "videoSizeStream" && endpoint.Response != "videoFrame" && endpoint.Response != "videoDecoderHealth" && endpoint.Response != "videoPixels" && endpoint.Response != "videoMatch" && endpoint.Response != "changeEventStream" && endpoint.Response != "audioLevel" && endpoint.Response != "audioLevelEventStream" && endpoint.Response != "mjpegVideoStream" && endpoint.Response != "videoSnapshot" && endpoint.Response != "replay" && endpoint.Response != "hls" && endpoint.Response != "encoders" && endpoint.Response != "displays" && endpoint.Response != "cameras" && endpoint.Response != "cameraSizes" && endpoint.Response != "apps" && endpoint.Response != "webSocket" {
 				os.Exit(1)
 			}
 
@@ -710,6 +929,10 @@ func main() {
 				os.Exit(1)
 			}
 
+			if endpoint.Template != "" && endpoint.Response != "videoMatch" {
+				os.Exit(1)
+			}
+
 			http.HandleFunc(endpointPath,
 				endpointHandler)
 		}
@@ -744,7 +967,7 @@ func main() {
 
 					fmt.Fprintln(os.Stderr, err)
 				} else if len(c) > 0 {
-					commandsRun(c)
+					commandsRun(c, nil, false)
 				}
 			}
 		}()
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+type matchCandidate struct {
+	x          int
+	y          int
+	difference int
+}
+
+func matchLoadTemplate(data []byte) *image.RGBA {
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	bounds := decoded.Bounds()
+	if bounds.Empty() {
+		return nil
+	}
+
+	template := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(template, template.Rect, decoded, bounds.Min, draw.Src)
+
+	return template
+}
+
+func matchGray(img *image.RGBA, rect image.Rectangle, factor int) ([]int, []bool, int, int) {
+	width := rect.Dx() / factor
+	height := rect.Dy() / factor
+	gray := make([]int, width*height)
+	mask := make([]bool, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum int
+			var opaque int
+
+			for dy := 0; dy < factor; dy++ {
+				row := img.Pix[(rect.Min.Y+y*factor+dy)*img.Stride:]
+
+				for dx := 0; dx < factor; dx++ {
+					i := (rect.Min.X + x*factor + dx) * 4
+					if row[i+3] < 0x80 {
+						continue
+					}
+
+					sum += (19595*int(row[i]) + 38470*int(row[i+1]) + 7471*int(row[i+2]) + 32768) >> 16
+					opaque++
+				}
+			}
+
+			if opaque*2 >= factor*factor {
+				gray[y*width+x] = sum / opaque
+				mask[y*width+x] = true
+			}
+		}
+	}
+
+	return gray, mask, width, height
+}
+
+func matchDifference(img *image.RGBA, template *image.RGBA, x int, y int) (int, int) {
+	var difference int
+	var count int
+
+	for ty := 0; ty < template.Rect.Dy(); ty++ {
+		imgRow := img.Pix[(y+ty)*img.Stride+x*4:]
+		templateRow := template.Pix[ty*template.Stride:]
+
+		for i := 0; i < template.Rect.Dx()*4; i += 4 {
+			if templateRow[i+3] < 0x80 {
+				continue
+			}
+
+			for c := 0; c < 3; c++ {
+				d := int(imgRow[i+c]) - int(templateRow[i+c])
+				if d < 0 {
+					d = -d
+				}
+
+				difference += d
+			}
+
+			count += 3
+		}
+	}
+
+	return difference, count
+}
+
+func matchFind(img *image.RGBA, template *image.RGBA, region image.Rectangle) (image.Point, float64, bool) {
+	if region.Empty() {
+		region = img.Rect
+	} else {
+		region = region.Intersect(img.Rect)
+	}
+
+	templateWidth := template.Rect.Dx()
+	templateHeight := template.Rect.Dy()
+
+	if region.Dx() < templateWidth || region.Dy() < templateHeight {
+		return image.Point{}, 0, false
+	}
+
+	factor := 1
+	for factor < 8 && templateWidth/(factor*2) >= 8 && templateHeight/(factor*2) >= 8 {
+		factor *= 2
+	}
+
+	gray, _, width, height := matchGray(img, region, factor)
+	templateGray, templateMask, coarseWidth, coarseHeight := matchGray(template, template.Rect, factor)
+
+	var candidates []matchCandidate
+
+	for y := 0; y+coarseHeight <= height; y++ {
+		for x := 0; x+coarseWidth <= width; x++ {
+			var difference int
+
+			worst := -1
+			if len(candidates) == 4 {
+				worst = candidates[3].difference
+			}
+
+			for ty := 0; ty < coarseHeight && (worst < 0 || difference < worst); ty++ {
+				row := gray[(y+ty)*width+x:]
+				templateRow := templateGray[ty*coarseWidth:]
+				maskRow := templateMask[ty*coarseWidth:]
+
+				for tx := 0; tx < coarseWidth; tx++ {
+					if !maskRow[tx] {
+						continue
+					}
+
+					d := row[tx] - templateRow[tx]
+					if d < 0 {
+						d = -d
+					}
+
+					difference += d
+				}
+			}
+
+			if worst >= 0 && difference >= worst {
+				continue
+			}
+
+			candidate := matchCandidate{x: x, y: y, difference: difference}
+			replaced := false
+
+			for i := range candidates {
+				dx := candidates[i].x - x
+				dy := candidates[i].y - y
+
+				if dx*dx+dy*dy < (coarseWidth*coarseWidth+coarseHeight*coarseHeight)/4 {
+					if difference < candidates[i].difference {
+						candidates[i] = candidate
+					}
+
+					replaced = true
+					break
+				}
+			}
+
+			if !replaced {
+				candidates = append(candidates, candidate)
+			}
+
+			for i := len(candidates) - 1; i > 0 && candidates[i].difference < candidates[i-1].difference; i-- {
+				candidates[i], candidates[i-1] = candidates[i-1], candidates[i]
+			}
+
+			if len(candidates) > 4 {
+				candidates = candidates[:4]
+			}
+		}
+	}
+
+	best := image.Point{}
+	bestDifference := -1
+	bestCount := 1
+
+	for _, candidate := range candidates {
+		for y := candidate.y*factor - factor; y <= candidate.y*factor+factor; y++ {
+			for x := candidate.x*factor - factor; x <= candidate.x*factor+factor; x++ {
+				if x < 0 || y < 0 || x+templateWidth > region.Dx() || y+templateHeight > region.Dy() {
+					continue
+				}
+
+				difference, count := matchDifference(img, template, region.Min.X+x, region.Min.Y+y)
+				if count == 0 {
+					continue
+				}
+
+				if bestDifference < 0 || difference*bestCount < bestDifference*count {
+					best = image.Pt(region.Min.X+x, region.Min.Y+y)
+					bestDifference = difference
+					bestCount = count
+				}
+			}
+		}
+	}
+
+	if bestDifference < 0 {
+		return image.Point{}, 0, false
+	}
+
+	return best, 1 - float64(bestDifference)/float64(bestCount)/255, true
+}
+
+func matchWait(template *image.RGBA, region image.Rectangle, tolerance float64, timeout time.Duration, done <-chan struct{}) (image.Rectangle, float64, bool) {
+	var deadline <-chan time.Time
+	if timeout >= 0 {
+		deadline = time.After(timeout)
+	}
+
+	for {
+		img, updated := videoFrameImage()
+
+		if img != nil {
+			point, score, ok := matchFind(img, template, region)
+			if ok && score >= 1-tolerance {
+				return image.Rectangle{Min: point, Max: point.Add(template.Rect.Size())}, score, true
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return image.Rectangle{}, 0, false
+		case <-done:
+			return image.Rectangle{}, 0, false
+		}
+	}
+}
+
+func matchParse(data []byte, toleranceString string, regionString string) (*image.RGBA, float64, image.Rectangle, bool) {
+	var region image.Rectangle
+	var err error
+
+	template := matchLoadTemplate(data)
+	if template == nil {
+		return nil, 0, region, false
+	}
+
+	tolerance := 0.05
+
+	if toleranceString != "" {
+		tolerance, err = strconv.ParseFloat(toleranceString, 64)
+		if err != nil || tolerance < 0 || tolerance > 1 {
+			return nil, 0, region, false
+		}
+	}
+
+	if regionString != "" {
+		numbers, ok := videoParseNumbers(regionString, 4)
+		if !ok || numbers[2] == 0 || numbers[3] == 0 {
+			return nil, 0, region, false
+		}
+
+		region = image.Rect(numbers[0], numbers[1], numbers[0]+numbers[2], numbers[1]+numbers[3])
+	}
+
+	return template, tolerance, region, true
+}
+
+func matchSend(w http.ResponseWriter, req *http.Request, templatePath string) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	var timeout time.Duration
+	var data []byte
+	var err error
+
+	if req.Method == http.MethodPost {
+		data, err = io.ReadAll(http.MaxBytesReader(w, req.Body, 16<<20))
+		if err != nil || len(data) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		data, err = os.ReadFile(templatePath)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	template, tolerance, region, ok := matchParse(data, query.Get("tolerance"), query.Get("region"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("timeout") != "" {
+		timeout, err = time.ParseDuration(query.Get("timeout"))
+		if err != nil || timeout < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	match, score, ok := matchWait(template, region, tolerance, timeout, req.Context().Done())
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(matchFormat(match, score)))
+}
+
+func matchFormat(match image.Rectangle, score float64) string {
+	return fmt.Sprintf("{\"x\":%d,\"y\":%d,\"width\":%d,\"height\":%d,\"score\":%.4f}", match.Min.X, match.Min.Y, match.Dx(), match.Dy(), score)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+)
+
+type mkvTrack struct {
+	number     uint64
+	codec      uint32
+	video      bool
+	config     []byte
+	configured bool
+	inband     bool
+	width      int
+	height     int
+}
+
+type mkvMuxer struct {
+	tracks      []*mkvTrack
+	initialized bool
+	started     bool
+	basePts     uint64
+	clusterOpen bool
+	clusterTime int64
+	queue       []mkvQueuedPacket
+}
+
+type mkvQueuedPacket struct {
+	track  *mkvTrack
+	packet []byte
+}
+
+const mkvQueueSize = 1024
+
+func mkvId(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+
+	return []byte{byte(id)}
+}
+
+func mkvElement(id uint32, payloads ...[]byte) []byte {
+	size := 0
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	element := binary.BigEndian.AppendUint64(mkvId(id), 0x0100000000000000|uint64(size))
+
+	for _, payload := range payloads {
+		element = append(element, payload...)
+	}
+
+	return element
+}
+
+func mkvUnknownSizeElement(id uint32) []byte {
+	return binary.BigEndian.AppendUint64(mkvId(id), 0x01FFFFFFFFFFFFFF)
+}
+
+func mkvUint(id uint32, v uint64) []byte {
+	return mkvElement(id, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func mkvFloat(id uint32, v float64) []byte {
+	return mkvElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func mkvString(id uint32, v string) []byte {
+	return mkvElement(id, []byte(v))
+}
+
+func newMkvMuxer() *mkvMuxer {
+	return &mkvMuxer{}
+}
+
+func (m *mkvMuxer) addVideoTrack(codec uint32, width int, height int) *mkvTrack {
+	track := &mkvTrack{
+		number: uint64(len(m.tracks) + 1),
+		codec:  codec,
+		video:  true,
+		width:  width,
+		height: height,
+	}
+
+	m.tracks = append(m.tracks, track)
+
+	return track
+}
+
+func (m *mkvMuxer) addAudioTrack(codec uint32) *mkvTrack {
+	track := &mkvTrack{
+		number:     uint64(len(m.tracks) + 1),
+		codec:      codec,
+		configured: codec == 0x00726177,
+	}
+
+	m.tracks = append(m.tracks, track)
+
+	return track
+}
+
+func (m *mkvMuxer) trackEntry(track *mkvTrack) []byte {
+	var codecId string
+	var codecPrivate []byte
+
+	switch track.codec {
+	case 0x68323634:
+		codecId = "V_MPEG4/ISO/AVC"
+		codecPrivate = avcConfigurationRecord(track.config)
+	case 0x68323635:
+		codecId = "V_MPEGH/ISO/HEVC"
+		codecPrivate = hevcConfigurationRecord(track.config)
+	case 0x617631:
+		codecId = "V_AV1"
+		codecPrivate = av1ConfigurationRecord(track.config)
+	case 0x6F707573:
+		codecId = "A_OPUS"
+		codecPrivate = track.config
+	case 0x00616163:
+		codecId = "A_AAC"
+		codecPrivate = track.config
+	case 0x666C6163:
+		codecId = "A_FLAC"
+		if len(track.config) >= 4 && string(track.config[:4]) == "fLaC" {
+			codecPrivate = track.config
+		} else {
+			codecPrivate = append([]byte{'f', 'L', 'a', 'C', 0x80, 0x00, 0x00, byte(len(track.config))}, track.config...)
+		}
+	case 0x00726177:
+		codecId = "A_PCM/INT/LIT"
+	default:
+		return nil
+	}
+
+	if codecPrivate == nil && track.codec != 0x00726177 {
+		return nil
+	}
+
+	var trackType uint64
+	var settings []byte
+
+	if track.video {
+		trackType = 1
+		settings = mkvElement(0xE0, mkvUint(0xB0, uint64(track.width)), mkvUint(0xBA, uint64(track.height)))
+	} else {
+		trackType = 2
+		settings = mkvElement(0xE1, mkvFloat(0xB5, 48000), mkvUint(0x9F, 2), mkvUint(0x6264, 16))
+	}
+
+	entry := [][]byte{
+		mkvUint(0xD7, track.number),
+		mkvUint(0x73C5, track.number),
+		mkvUint(0x83, trackType),
+		mkvUint(0x9C, 0),
+		mkvString(0x86, codecId),
+	}
+
+	if codecPrivate != nil {
+		entry = append(entry, mkvElement(0x63A2, codecPrivate))
+	}
+
+	return mkvElement(0xAE, append(entry, settings)...)
+}
+
+func (m *mkvMuxer) header() []byte {
+	var entries [][]byte
+
+	for _, track := range m.tracks {
+		entry := m.trackEntry(track)
+		if entry == nil {
+			return nil
+		}
+
+		entries = append(entries, entry)
+	}
+
+	data := mkvElement(
+		0x1A45DFA3,
+		mkvUint(0x4286, 1),
+		mkvUint(0x42F7, 1),
+		mkvUint(0x42F2, 4),
+		mkvUint(0x42F3, 8),
+		mkvString(0x4282, "matroska"),
+		mkvUint(0x4287, 4),
+		mkvUint(0x4285, 2),
+	)
+
+	data = append(data, mkvUnknownSizeElement(0x18538067)...)
+	data = append(data, mkvElement(
+		0x1549A966,
+		mkvUint(0x2AD7B1, 1000000),
+		mkvString(0x4D80, "headless-scrcpy-client"),
+		mkvString(0x5741, "headless-scrcpy-client"),
+	)...)
+	data = append(data, mkvElement(0x1654AE6B, entries...)...)
+
+	return data
+}
+
+func (m *mkvMuxer) push(track *mkvTrack, packet []byte) []byte {
+	var data []byte
+
+	if packetIsConfig(packet) {
+		track.config = packet[12:]
+
+		if track.configured && m.initialized {
+			track.inband = true
+		}
+
+		if track.video && !m.initialized {
+			width, height, ok := videoConfigSize(track.codec, track.config)
+			if ok {
+				track.width = width
+				track.height = height
+			}
+		}
+
+		track.configured = true
+		return nil
+	}
+
+	if !m.initialized {
+		configured := true
+		for _, t := range m.tracks {
+			if !t.configured {
+				configured = false
+			}
+		}
+
+		if configured {
+			data = m.header()
+		}
+
+		if data == nil {
+			if len(m.queue) < mkvQueueSize {
+				m.queue = append(m.queue, mkvQueuedPacket{track: track, packet: packet})
+			}
+
+			return nil
+		}
+
+		m.initialized = true
+
+		queue := m.queue
+		m.queue = nil
+
+		for _, queued := range queue {
+			data = append(data, m.push(queued.track, queued.packet)...)
+		}
+	}
+
+	keyframe := packetIsKeyframe(packet) || !track.video
+	pts := packetPts(packet)
+
+	if !m.started {
+		for _, t := range m.tracks {
+			if t.video && (t != track || !keyframe) {
+				return data
+			}
+		}
+
+		m.basePts = pts
+		m.started = true
+	}
+
+	if pts < m.basePts {
+		return data
+	}
+
+	timestamp := int64((pts - m.basePts) / 1000)
+
+	if !m.clusterOpen || (track.video && keyframe) || timestamp-m.clusterTime > 30000 || m.clusterTime-timestamp > 30000 {
+		data = append(data, mkvUnknownSizeElement(0x1F43B675)...)
+		data = append(data, mkvUint(0xE7, uint64(timestamp))...)
+		m.clusterOpen = true
+		m.clusterTime = timestamp
+	}
+
+	var sample []byte
+
+	if track.video {
+		if track.inband && keyframe {
+			sample = videoSample(track.codec, track.config)
+			track.inband = false
+		}
+
+		sample = append(sample, videoSample(track.codec, packet[12:])...)
+	} else {
+		sample = packet[12:]
+	}
+
+	block := []byte{0x80 | byte(track.number), 0, 0, 0}
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(timestamp-m.clusterTime)))
+	if keyframe {
+		block[3] = 0x80
+	}
+
+	return append(data, mkvElement(0xA3, block, sample)...)
+}
+
+func mkvRun(w io.Writer, videoPackets chan []byte, audioPackets chan []byte, done <-chan struct{}) {
+	muxer := newMkvMuxer()
+
+	var videoTrack *mkvTrack
+	var audioTrack *mkvTrack
+
+	if videoPackets != nil {
+		videoTrack = muxer.addVideoTrack(videoCodec, initialVideoWidth, initialVideoHeight)
+	}
+
+	if audioPackets != nil {
+		audioTrack = muxer.addAudioTrack(audioCodec)
+	}
+
+	var data []byte
+	var n int
+	var err error
+
+	for {
+		select {
+		case packet, ok := <-videoPackets:
+			if !ok {
+				return
+			}
+
+			data = muxer.push(videoTrack, packet)
+		case packet, ok := <-audioPackets:
+			if !ok {
+				return
+			}
+
+			data = muxer.push(audioTrack, packet)
+		case <-done:
+			return
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		n, err = w.Write(data)
+		if err != nil {
+			return
+		}
+		if n < len(data) {
+			return
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+func mkvSendStream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video && !config.Scrcpy.Audio {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var videoPackets chan []byte
+	var audioPackets chan []byte
+
+	if config.Scrcpy.Video {
+		videoPackets = videoBroadcaster.subscribe(req.Context().Done())
+		if videoPackets == nil {
+			return
+		}
+		defer videoBroadcaster.unsubscribe(videoPackets)
+	}
+
+	if config.Scrcpy.Audio {
+		audioPackets = audioBroadcaster.subscribe(req.Context().Done())
+		if audioPackets == nil {
+			return
+		}
+		defer audioBroadcaster.unsubscribe(audioPackets)
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name")
+	}
+
+	w.Header().Set("Content-Type", "video/x-matroska")
+	w.Header().Set("Device-Name", deviceName)
+
+	mkvRun(w, videoPackets, audioPackets, req.Context().Done())
+}
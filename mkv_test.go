@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"testing"
+)
+
+type mkvTestElement struct {
+	id      uint32
+	path    []uint32
+	payload []byte
+}
+
+func mkvTestVint(t *testing.T, data []byte, marker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		t.Fatalf("invalid vint, %d bytes left", len(data))
+	}
+
+	length := bits.LeadingZeros8(data[0]) + 1
+	if length > len(data) {
+		t.Fatalf("vint length %d, %d bytes left", length, len(data))
+	}
+
+	value := uint64(data[0])
+	if !marker {
+		value &= 0xFF >> length
+	}
+
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, length
+}
+
+func mkvTestElements(t *testing.T, path []uint32, data []byte) []mkvTestElement {
+	var elements []mkvTestElement
+
+	for len(data) > 0 {
+		id, idLength := mkvTestVint(t, data, true)
+		size, sizeLength := mkvTestVint(t, data[idLength:], false)
+		data = data[idLength+sizeLength:]
+
+		if size == 1<<(7*sizeLength)-1 {
+			size = uint64(len(data))
+		}
+
+		if size > uint64(len(data)) {
+			t.Fatalf("element %x: size %d, %d bytes left", id, size, len(data))
+		}
+
+		element := mkvTestElement{id: uint32(id), path: append(append([]uint32{}, path...), uint32(id)), payload: data[:size]}
+		elements = append(elements, element)
+
+		switch id {
+		case 0x1A45DFA3, 0x18538067, 0x1549A966, 0x1654AE6B, 0xAE, 0xE0, 0xE1:
+			elements = append(elements, mkvTestElements(t, element.path, element.payload)...)
+		}
+
+		data = data[size:]
+	}
+
+	return elements
+}
+
+func mkvTestFind(elements []mkvTestElement, path ...uint32) []byte {
+	for _, element := range elements {
+		if len(element.path) != len(path) {
+			continue
+		}
+
+		found := true
+		for i := range path {
+			if element.path[i] != path[i] {
+				found = false
+			}
+		}
+
+		if found {
+			return element.payload
+		}
+	}
+
+	return nil
+}
+
+func TestMkvId(t *testing.T) {
+	tests := []struct {
+		id    uint32
+		bytes int
+	}{
+		{0x83, 1},
+		{0xAE, 1},
+		{0x4286, 2},
+		{0x63A2, 2},
+		{0x2AD7B1, 3},
+		{0x1A45DFA3, 4},
+		{0x1F43B675, 4},
+	}
+
+	for _, test := range tests {
+		id := mkvId(test.id)
+		if len(id) != test.bytes {
+			t.Errorf("%x: %d bytes, want %d", test.id, len(id), test.bytes)
+		}
+
+		if value, length := mkvTestVint(t, id, true); uint32(value) != test.id || length != test.bytes {
+			t.Errorf("%x: decoded %x in %d bytes", test.id, value, length)
+		}
+	}
+}
+
+func TestMkvElement(t *testing.T) {
+	tests := []struct {
+		name    string
+		element []byte
+		id      uint32
+		size    int
+	}{
+		{"empty", mkvElement(0xEC), 0xEC, 0},
+		{"uint", mkvUint(0xD7, 1), 0xD7, 8},
+		{"float", mkvFloat(0xB5, 48000), 0xB5, 8},
+		{"string", mkvString(0x4282, "matroska"), 0x4282, 8},
+		{"payloads", mkvElement(0xA3, []byte{0x81}, []byte{0, 0, 0x80}, make([]byte, 1000)), 0xA3, 1004},
+		{"nested", mkvElement(0xE0, mkvUint(0xB0, 1080), mkvUint(0xBA, 2400)), 0xE0, 34},
+		{"large", mkvElement(0x1F43B675, make([]byte, 1<<20)), 0x1F43B675, 1 << 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			elements := mkvTestElements(t, nil, test.element)
+
+			if elements[0].id != test.id {
+				t.Errorf("id %x, want %x", elements[0].id, test.id)
+			}
+
+			if len(elements[0].payload) != test.size {
+				t.Errorf("size %d, want %d", len(elements[0].payload), test.size)
+			}
+
+			if len(test.element) != len(mkvId(test.id))+8+test.size {
+				t.Errorf("length %d, want %d", len(test.element), len(mkvId(test.id))+8+test.size)
+			}
+		})
+	}
+
+	if element := mkvUnknownSizeElement(0x18538067); len(element) != 12 || binary.BigEndian.Uint64(element[4:]) != 0x01FFFFFFFFFFFFFF {
+		t.Errorf("unknown size element %x", element)
+	}
+}
+
+func TestMkvHeaderSize(t *testing.T) {
+	h264Config := append([]byte{0, 0, 0, 1}, h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 0, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}, vui: true})...)
+	h264Config = append(h264Config, 0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80)
+
+	h265Config := []byte{0, 0, 0, 1, 0x40, 0x01, 0x0C, 0x01, 0xFF, 0xFF, 0, 0, 0, 1}
+	h265Config = append(h265Config, h265TestSps(h265SpsTest{maxSubLayersMinus1: 1, chromaFormatIdc: 1, width: 1088, height: 2400, conformanceWindow: []uint64{0, 4, 0, 0}})...)
+	h265Config = append(h265Config, 0, 0, 0, 1, 0x44, 0x01, 0xC1, 0x72, 0xB4, 0x62, 0x40)
+
+	tests := []struct {
+		name    string
+		codec   uint32
+		config  []byte
+		codecId string
+		width   uint64
+		height  uint64
+	}{
+		{"h264", 0x68323634, h264Config, "V_MPEG4/ISO/AVC", 1920, 1080},
+		{"h265", 0x68323635, h265Config, "V_MPEGH/ISO/HEVC", 1080, 2400},
+		{"av1", 0x617631, av1TestObus(av1SequenceHeaderTest{reduced: true, width: 720, height: 1600}), "V_AV1", 720, 1600},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			muxer := newMkvMuxer()
+			track := muxer.addVideoTrack(test.codec, 640, 480)
+			muxer.push(track, packetTest(true, false, 0, test.config))
+
+			header := muxer.header()
+			if header == nil {
+				t.Fatal("no header")
+			}
+
+			elements := mkvTestElements(t, nil, header)
+
+			if codecId := mkvTestFind(elements, 0x18538067, 0x1654AE6B, 0xAE, 0x86); string(codecId) != test.codecId {
+				t.Errorf("codec id %q, want %q", codecId, test.codecId)
+			}
+
+			if mkvTestFind(elements, 0x18538067, 0x1654AE6B, 0xAE, 0x63A2) == nil {
+				t.Error("no codec private")
+			}
+
+			width := mkvTestFind(elements, 0x18538067, 0x1654AE6B, 0xAE, 0xE0, 0xB0)
+			height := mkvTestFind(elements, 0x18538067, 0x1654AE6B, 0xAE, 0xE0, 0xBA)
+			if len(width) != 8 || len(height) != 8 {
+				t.Fatal("no pixel size")
+			}
+
+			if binary.BigEndian.Uint64(width) != test.width || binary.BigEndian.Uint64(height) != test.height {
+				t.Errorf("pixel size %dx%d, want %dx%d", binary.BigEndian.Uint64(width), binary.BigEndian.Uint64(height), test.width, test.height)
+			}
+		})
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+)
+
+type mp4Track struct {
+	id           uint32
+	codec        uint32
+	video        bool
+	config       []byte
+	inbandConfig []byte
+	width        int
+	height       int
+	pending      []byte
+	duration     uint64
+}
+
+type mp4Muxer struct {
+	tracks         []*mp4Track
+	inband         bool
+	sequenceNumber uint32
+	basePts        uint64
+	started        bool
+	initialized    bool
+	queue          []mp4QueuedPacket
+}
+
+type mp4QueuedPacket struct {
+	track  *mp4Track
+	packet []byte
+}
+
+const mp4QueueSize = 1024
+
+var mp4Matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+}
+
+func packetPts(packet []byte) uint64 {
+	return binary.BigEndian.Uint64(packet[:8]) & 0x3FFFFFFFFFFFFFFF
+}
+
+func annexbNalUnits(data []byte) [][]byte {
+	var nalUnits [][]byte
+	start := -1
+	i := 0
+
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				nalUnits = append(nalUnits, data[start:end])
+			}
+
+			i += 3
+			start = i
+		} else {
+			i++
+		}
+	}
+
+	if start >= 0 && start < len(data) {
+		nalUnits = append(nalUnits, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		nalUnits = append(nalUnits, data)
+	}
+
+	return nalUnits
+}
+
+func nalUnitRbsp(nalUnit []byte) []byte {
+	rbsp := make([]byte, 0, len(nalUnit))
+
+	for i := 0; i < len(nalUnit); i++ {
+		if nalUnit[i] == 3 && len(rbsp) >= 2 && rbsp[len(rbsp)-1] == 0 && rbsp[len(rbsp)-2] == 0 {
+			continue
+		}
+
+		rbsp = append(rbsp, nalUnit[i])
+	}
+
+	return rbsp
+}
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], boxType)
+
+	for _, payload := range payloads {
+		box = append(box, payload...)
+	}
+
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	return mp4Box(boxType, append([][]byte{{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}}, payloads...)...)
+}
+
+func mp4Uint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func avcConfigurationRecord(config []byte) []byte {
+	var sps []byte
+	var pps []byte
+
+	for _, nalUnit := range annexbNalUnits(config) {
+		if len(nalUnit) == 0 {
+			continue
+		}
+
+		switch nalUnit[0] & 0x1F {
+		case 7:
+			if sps == nil {
+				sps = nalUnit
+			}
+		case 8:
+			if pps == nil {
+				pps = nalUnit
+			}
+		}
+	}
+
+	if len(sps) < 4 || pps == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+
+	b.Write([]byte{0x01, sps[1], sps[2], sps[3], 0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(len(sps)))
+	b.Write(sps)
+	b.WriteByte(0x01)
+	binary.Write(&b, binary.BigEndian, uint16(len(pps)))
+	b.Write(pps)
+
+	return b.Bytes()
+}
+
+func hevcConfigurationRecord(config []byte) []byte {
+	var vps [][]byte
+	var sps [][]byte
+	var pps [][]byte
+
+	for _, nalUnit := range annexbNalUnits(config) {
+		if len(nalUnit) < 2 {
+			continue
+		}
+
+		switch (nalUnit[0] >> 1) & 0x3F {
+		case 32:
+			vps = append(vps, nalUnit)
+		case 33:
+			sps = append(sps, nalUnit)
+		case 34:
+			pps = append(pps, nalUnit)
+		}
+	}
+
+	if len(sps) == 0 {
+		return nil
+	}
+
+	rbsp := nalUnitRbsp(sps[0][2:])
+	if len(rbsp) < 13 {
+		return nil
+	}
+
+	maxSubLayersMinus1 := (rbsp[0] >> 1) & 0x07
+	temporalIdNesting := rbsp[0] & 0x01
+
+	var b bytes.Buffer
+
+	b.WriteByte(0x01)
+	b.Write(rbsp[1:13])
+	b.Write([]byte{0xF0, 0x00, 0xFC, 0xFD, 0xF8, 0xF8, 0x00, 0x00})
+	b.WriteByte((maxSubLayersMinus1+1)<<3 | temporalIdNesting<<2 | 0x03)
+	b.WriteByte(3)
+
+	for i, nalUnits := range [][][]byte{vps, sps, pps} {
+		b.WriteByte(0x80 | byte(32+i))
+		binary.Write(&b, binary.BigEndian, uint16(len(nalUnits)))
+
+		for _, nalUnit := range nalUnits {
+			binary.Write(&b, binary.BigEndian, uint16(len(nalUnit)))
+			b.Write(nalUnit)
+		}
+	}
+
+	return b.Bytes()
+}
+
+func av1ConfigurationRecord(config []byte) []byte {
+	if len(config) == 0 {
+		return nil
+	}
+
+	if config[0] == 0x81 {
+		return config
+	}
+
+	var profile byte
+	level := byte(31)
+
+	if (config[0]>>3)&0x0F == 1 {
+		offset := 1
+		if config[0]&0x04 != 0 {
+			offset++
+		}
+
+		if config[0]&0x02 != 0 {
+			for offset < len(config) && config[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+
+		if offset+1 < len(config) {
+			profile = config[offset] >> 5
+
+			if config[offset]&0x08 != 0 {
+				level = (config[offset]&0x07)<<2 | config[offset+1]>>6
+			}
+		}
+	}
+
+	return append([]byte{0x81, profile<<5 | level, 0x0C, 0x00}, config...)
+}
+
+func videoConfigurationRecord(codec uint32, config []byte) []byte {
+	switch codec {
+	case 0x68323634:
+		return avcConfigurationRecord(config)
+	case 0x68323635:
+		return hevcConfigurationRecord(config)
+	case 0x617631:
+		return av1ConfigurationRecord(config)
+	}
+
+	return nil
+}
+
+func videoSample(codec uint32, payload []byte) []byte {
+	if codec != 0x68323634 && codec != 0x68323635 {
+		return payload
+	}
+
+	var sample []byte
+
+	for _, nalUnit := range annexbNalUnits(payload) {
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalUnit)))
+		sample = append(sample, nalUnit...)
+	}
+
+	return sample
+}
+
+func mp4VideoSampleEntry(track *mp4Track, inband bool) []byte {
+	record := videoConfigurationRecord(track.codec, track.config)
+	if record == nil {
+		return nil
+	}
+
+	var boxType string
+	var recordBoxType string
+
+	switch track.codec {
+	case 0x68323634:
+		boxType = "avc1"
+		if inband {
+			boxType = "avc3"
+		}
+		recordBoxType = "avcC"
+	case 0x68323635:
+		boxType = "hvc1"
+		if inband {
+			boxType = "hev1"
+		}
+		recordBoxType = "hvcC"
+	case 0x617631:
+		boxType = "av01"
+		recordBoxType = "av1C"
+	}
+
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[24:], uint16(track.width))
+	binary.BigEndian.PutUint16(entry[26:], uint16(track.height))
+	binary.BigEndian.PutUint32(entry[28:], 0x00480000)
+	binary.BigEndian.PutUint32(entry[32:], 0x00480000)
+	binary.BigEndian.PutUint16(entry[40:], 1)
+	binary.BigEndian.PutUint16(entry[74:], 0x0018)
+	binary.BigEndian.PutUint16(entry[76:], 0xFFFF)
+
+	return mp4Box(boxType, entry, mp4Box(recordBoxType, record))
+}
+
+func mp4AudioSampleEntry(track *mp4Track) []byte {
+	var boxType string
+	var codecConfig []byte
+
+	switch track.codec {
+	case 0x6F707573:
+		if len(track.config) < 19 || string(track.config[:8]) != "OpusHead" {
+			return nil
+		}
+
+		dops := []byte{0x00, track.config[9]}
+		dops = binary.BigEndian.AppendUint16(dops, binary.LittleEndian.Uint16(track.config[10:]))
+		dops = binary.BigEndian.AppendUint32(dops, binary.LittleEndian.Uint32(track.config[12:]))
+		dops = binary.BigEndian.AppendUint16(dops, binary.LittleEndian.Uint16(track.config[16:]))
+		dops = append(dops, track.config[18:]...)
+
+		boxType = "Opus"
+		codecConfig = mp4Box("dOps", dops)
+	case 0x00616163:
+		if len(track.config) == 0 {
+			return nil
+		}
+
+		decoderSpecificInfo := append([]byte{0x05, byte(len(track.config))}, track.config...)
+		decoderConfig := append([]byte{0x04, byte(13 + len(decoderSpecificInfo)), 0x40, 0x15}, make([]byte, 11)...)
+		decoderConfig = append(decoderConfig, decoderSpecificInfo...)
+		esDescriptor := append([]byte{0x03, byte(3 + len(decoderConfig) + 3), 0x00, 0x00, 0x00}, decoderConfig...)
+		esDescriptor = append(esDescriptor, 0x06, 0x01, 0x02)
+
+		boxType = "mp4a"
+		codecConfig = mp4FullBox("esds", 0, 0, esDescriptor)
+	case 0x666C6163:
+		streamInfo := track.config
+		if len(streamInfo) >= 8 && string(streamInfo[:4]) == "fLaC" {
+			streamInfo = streamInfo[8:]
+		}
+
+		if len(streamInfo) == 0 {
+			return nil
+		}
+
+		boxType = "fLaC"
+		codecConfig = mp4FullBox("dfLa", 0, 0, []byte{0x80, 0x00, 0x00, byte(len(streamInfo))}, streamInfo)
+	case 0x00726177:
+		boxType = "sowt"
+	default:
+		return nil
+	}
+
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[16:], 2)
+	binary.BigEndian.PutUint16(entry[18:], 16)
+	binary.BigEndian.PutUint32(entry[24:], 48000<<16)
+
+	return mp4Box(boxType, entry, codecConfig)
+}
+
+func newMp4Muxer(inband bool) *mp4Muxer {
+	return &mp4Muxer{
+		inband: inband,
+	}
+}
+
+func (m *mp4Muxer) addVideoTrack(codec uint32, width int, height int) *mp4Track {
+	track := &mp4Track{
+		id:     uint32(len(m.tracks) + 1),
+		codec:  codec,
+		video:  true,
+		width:  width,
+		height: height,
+	}
+
+	m.tracks = append(m.tracks, track)
+
+	return track
+}
+
+func (m *mp4Muxer) addAudioTrack(codec uint32) *mp4Track {
+	track := &mp4Track{
+		id:    uint32(len(m.tracks) + 1),
+		codec: codec,
+	}
+
+	m.tracks = append(m.tracks, track)
+
+	return track
+}
+
+func (m *mp4Muxer) initSegment() []byte {
+	var traks []byte
+	var trexs []byte
+
+	for _, track := range m.tracks {
+		var sampleEntry []byte
+		var handlerType string
+		var handlerName string
+		var mediaHeader []byte
+
+		tkhd := make([]byte, 80)
+		binary.BigEndian.PutUint32(tkhd[8:], track.id)
+		copy(tkhd[36:], mp4Matrix)
+
+		if track.video {
+			sampleEntry = mp4VideoSampleEntry(track, m.inband)
+			handlerType = "vide"
+			handlerName = "VideoHandler\x00"
+			mediaHeader = mp4FullBox("vmhd", 0, 0x000001, make([]byte, 8))
+			binary.BigEndian.PutUint32(tkhd[72:], uint32(track.width)<<16)
+			binary.BigEndian.PutUint32(tkhd[76:], uint32(track.height)<<16)
+		} else {
+			sampleEntry = mp4AudioSampleEntry(track)
+			handlerType = "soun"
+			handlerName = "SoundHandler\x00"
+			mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+			binary.BigEndian.PutUint16(tkhd[32:], 0x0100)
+		}
+
+		if sampleEntry == nil {
+			return nil
+		}
+
+		mdhd := make([]byte, 20)
+		binary.BigEndian.PutUint32(mdhd[8:], 1000000)
+		binary.BigEndian.PutUint16(mdhd[16:], 0x55C4)
+
+		traks = append(traks, mp4Box(
+			"trak",
+			mp4FullBox("tkhd", 0, 0x000003, tkhd),
+			mp4Box(
+				"mdia",
+				mp4FullBox("mdhd", 0, 0, mdhd),
+				mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte(handlerType), make([]byte, 12), []byte(handlerName)),
+				mp4Box(
+					"minf",
+					mediaHeader,
+					mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 0x000001))),
+					mp4Box(
+						"stbl",
+						mp4FullBox("stsd", 0, 0, mp4Uint32(1), sampleEntry),
+						mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+						mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+						mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+						mp4FullBox("stco", 0, 0, mp4Uint32(0)),
+					),
+				),
+			),
+		)...)
+
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4Uint32(track.id), mp4Uint32(1), make([]byte, 12))...)
+	}
+
+	mvhd := make([]byte, 96)
+	binary.BigEndian.PutUint32(mvhd[8:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 0x00010000)
+	binary.BigEndian.PutUint16(mvhd[20:], 0x0100)
+	copy(mvhd[32:], mp4Matrix)
+	binary.BigEndian.PutUint32(mvhd[92:], uint32(len(m.tracks)+1))
+
+	return append(
+		mp4Box("ftyp", []byte("isom"), mp4Uint32(0x200), []byte("isomiso6mp41")),
+		mp4Box("moov", mp4FullBox("mvhd", 0, 0, mvhd), traks, mp4Box("mvex", trexs))...,
+	)
+}
+
+func (m *mp4Muxer) fragment(track *mp4Track, packet []byte, duration uint64) []byte {
+	sample := packet[12:]
+	if track.video {
+		sample = videoSample(track.codec, sample)
+	}
+	pts := packetPts(packet)
+
+	var decodeTime uint64
+	if pts > m.basePts {
+		decodeTime = pts - m.basePts
+	}
+
+	var sampleFlags uint32
+	if packetIsKeyframe(packet) || !track.video {
+		sampleFlags = 0x02000000
+	} else {
+		sampleFlags = 0x01010000
+	}
+
+	m.sequenceNumber++
+
+	moof := mp4Box(
+		"moof",
+		mp4FullBox("mfhd", 0, 0, mp4Uint32(m.sequenceNumber)),
+		mp4Box(
+			"traf",
+			mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(track.id)),
+			mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, decodeTime)),
+			mp4FullBox("trun", 0, 0x000701, mp4Uint32(1), mp4Uint32(0), mp4Uint32(uint32(duration)), mp4Uint32(uint32(len(sample))), mp4Uint32(sampleFlags)),
+		),
+	)
+
+	binary.BigEndian.PutUint32(moof[len(moof)-16:], uint32(len(moof)+8))
+
+	return append(moof, mp4Box("mdat", sample)...)
+}
+
+func (m *mp4Muxer) flush(track *mp4Track) []byte {
+	if track.pending == nil {
+		return nil
+	}
+
+	duration := track.duration
+	if duration == 0 {
+		duration = 16666
+	}
+
+	data := m.fragment(track, track.pending, duration)
+	track.pending = nil
+
+	return data
+}
+
+func (m *mp4Muxer) push(track *mp4Track, packet []byte) []byte {
+	var data []byte
+
+	if packetIsConfig(packet) {
+		if m.inband && m.initialized {
+			track.inbandConfig = packet[12:]
+			return nil
+		}
+
+		for _, t := range m.tracks {
+			data = append(data, m.flush(t)...)
+		}
+
+		track.config = packet[12:]
+		m.initialized = false
+
+		if track.video {
+			width, height, ok := videoConfigSize(track.codec, track.config)
+			if ok {
+				track.width = width
+				track.height = height
+			}
+		}
+
+		return data
+	}
+
+	if !m.initialized {
+		data = m.initSegment()
+		if data == nil {
+			if len(m.queue) < mp4QueueSize {
+				m.queue = append(m.queue, mp4QueuedPacket{track: track, packet: packet})
+			}
+
+			return nil
+		}
+
+		m.initialized = true
+
+		queue := m.queue
+		m.queue = nil
+
+		for _, queued := range queue {
+			data = append(data, m.push(queued.track, queued.packet)...)
+		}
+	}
+
+	keyframe := packetIsKeyframe(packet)
+	pts := packetPts(packet)
+
+	if !m.started {
+		for _, t := range m.tracks {
+			if t.video && (t != track || !keyframe) {
+				return data
+			}
+		}
+
+		m.basePts = pts
+		m.started = true
+	}
+
+	if pts < m.basePts {
+		return data
+	}
+
+	if track.video {
+		if track.pending == nil && !keyframe {
+			return data
+		}
+
+		if track.inbandConfig != nil && keyframe {
+			inbandPacket := make([]byte, 12, len(packet)+len(track.inbandConfig))
+			copy(inbandPacket, packet[:12])
+			inbandPacket = append(inbandPacket, track.inbandConfig...)
+			packet = append(inbandPacket, packet[12:]...)
+			track.inbandConfig = nil
+		}
+	}
+
+	if track.pending != nil {
+		pendingPts := packetPts(track.pending)
+		if pts > pendingPts {
+			track.duration = pts - pendingPts
+		}
+
+		data = append(data, m.fragment(track, track.pending, track.duration)...)
+	}
+
+	track.pending = packet
+
+	return data
+}
+
+func mp4Run(w io.Writer, videoPackets chan []byte, audioPackets chan []byte, inband bool, done <-chan struct{}) {
+	muxer := newMp4Muxer(inband)
+
+	var videoTrack *mp4Track
+	var audioTrack *mp4Track
+
+	if videoPackets != nil {
+		videoTrack = muxer.addVideoTrack(videoCodec, initialVideoWidth, initialVideoHeight)
+	}
+
+	if audioPackets != nil {
+		audioTrack = muxer.addAudioTrack(audioCodec)
+	}
+
+	var data []byte
+	var n int
+	var err error
+
+	for {
+		select {
+		case packet, ok := <-videoPackets:
+			if !ok {
+				videoPackets = nil
+				audioPackets = nil
+				break
+			}
+
+			data = muxer.push(videoTrack, packet)
+		case packet, ok := <-audioPackets:
+			if !ok {
+				videoPackets = nil
+				audioPackets = nil
+				break
+			}
+
+			data = muxer.push(audioTrack, packet)
+		case <-done:
+			videoPackets = nil
+			audioPackets = nil
+		}
+
+		if videoPackets == nil && audioPackets == nil {
+			data = nil
+
+			for _, track := range muxer.tracks {
+				data = append(data, muxer.flush(track)...)
+			}
+
+			w.Write(data)
+			return
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		n, err = w.Write(data)
+		if err != nil {
+			return
+		}
+		if n < len(data) {
+			return
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type mp4TestBox struct {
+	boxType string
+	path    string
+	payload []byte
+}
+
+func packetTest(config bool, keyframe bool, pts uint64, payload []byte) []byte {
+	if config {
+		pts |= 1 << 63
+	}
+
+	if keyframe {
+		pts |= 1 << 62
+	}
+
+	packet := binary.BigEndian.AppendUint64(nil, pts)
+	packet = binary.BigEndian.AppendUint32(packet, uint32(len(payload)))
+
+	return append(packet, payload...)
+}
+
+func mp4TestBoxes(t *testing.T, path string, data []byte) []mp4TestBox {
+	var boxes []mp4TestBox
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%s: %d trailing bytes", path, len(data))
+		}
+
+		size := int(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+
+		if size < 8 || size > len(data) {
+			t.Fatalf("%s/%s: size %d, %d bytes left", path, boxType, size, len(data))
+		}
+
+		box := mp4TestBox{boxType: boxType, path: path + "/" + boxType, payload: data[8:size]}
+		boxes = append(boxes, box)
+
+		children := -1
+
+		switch boxType {
+		case "moov", "trak", "mdia", "minf", "dinf", "stbl", "mvex", "moof", "traf":
+			children = 0
+		case "stsd", "dref":
+			children = 8
+		case "avc1", "avc3", "hvc1", "hev1", "av01":
+			children = 78
+		}
+
+		if children >= 0 {
+			if children > len(box.payload) {
+				t.Fatalf("%s: payload %d bytes, want at least %d", box.path, len(box.payload), children)
+			}
+
+			boxes = append(boxes, mp4TestBoxes(t, box.path, box.payload[children:])...)
+		}
+
+		data = data[size:]
+	}
+
+	return boxes
+}
+
+func mp4TestFind(boxes []mp4TestBox, path string) []byte {
+	for _, box := range boxes {
+		if box.path == path {
+			return box.payload
+		}
+	}
+
+	return nil
+}
+
+func TestMp4Box(t *testing.T) {
+	tests := []struct {
+		name    string
+		box     []byte
+		boxType string
+		size    int
+	}{
+		{"empty", mp4Box("free"), "free", 8},
+		{"payload", mp4Box("mdat", make([]byte, 100)), "mdat", 108},
+		{"payloads", mp4Box("ftyp", []byte("isom"), mp4Uint32(0x200), []byte("isomiso6mp41")), "ftyp", 28},
+		{"nested", mp4Box("moov", mp4Box("mvex", mp4Box("free")), mp4Box("free", []byte{1})), "moov", 33},
+		{"full box", mp4FullBox("mfhd", 0, 0, mp4Uint32(1)), "mfhd", 16},
+		{"full box without payload", mp4FullBox("url ", 0, 0x000001), "url ", 12},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if len(test.box) != test.size {
+				t.Errorf("length %d, want %d", len(test.box), test.size)
+			}
+
+			if size := int(binary.BigEndian.Uint32(test.box)); size != test.size {
+				t.Errorf("size %d, want %d", size, test.size)
+			}
+
+			if string(test.box[4:8]) != test.boxType {
+				t.Errorf("type %q, want %q", test.box[4:8], test.boxType)
+			}
+
+			mp4TestBoxes(t, "", test.box)
+		})
+	}
+
+	if box := mp4FullBox("tfhd", 1, 0x020000, mp4Uint32(1)); !bytes.Equal(box[8:12], []byte{1, 0x02, 0x00, 0x00}) {
+		t.Errorf("full box header %x, want 01020000", box[8:12])
+	}
+}
+
+func TestMp4InitSegmentSize(t *testing.T) {
+	h264Config := append([]byte{0, 0, 0, 1}, h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 68, heightInMapUnit: 150, frameMbsOnly: true, crop: []uint64{0, 4, 0, 0}, vui: true})...)
+	h264Config = append(h264Config, 0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80)
+
+	h265Config := []byte{0, 0, 0, 1, 0x40, 0x01, 0x0C, 0x01, 0xFF, 0xFF, 0, 0, 0, 1}
+	h265Config = append(h265Config, h265TestSps(h265SpsTest{chromaFormatIdc: 1, width: 1920, height: 1088, conformanceWindow: []uint64{0, 0, 0, 4}})...)
+	h265Config = append(h265Config, 0, 0, 0, 1, 0x44, 0x01, 0xC1, 0x72, 0xB4, 0x62, 0x40)
+
+	av1Config := av1TestObus(av1SequenceHeaderTest{operatingPoints: 1, width: 720, height: 1600})
+
+	tests := []struct {
+		name       string
+		codec      uint32
+		config     []byte
+		inband     bool
+		sampleType string
+		recordType string
+		width      int
+		height     int
+	}{
+		{"h264", 0x68323634, h264Config, false, "avc1", "avcC", 1080, 2400},
+		{"h264 inband", 0x68323634, h264Config, true, "avc3", "avcC", 1080, 2400},
+		{"h265", 0x68323635, h265Config, false, "hvc1", "hvcC", 1920, 1080},
+		{"h265 inband", 0x68323635, h265Config, true, "hev1", "hvcC", 1920, 1080},
+		{"av1", 0x617631, av1Config, false, "av01", "av1C", 720, 1600},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			muxer := newMp4Muxer(test.inband)
+			track := muxer.addVideoTrack(test.codec, 640, 480)
+			muxer.push(track, packetTest(true, false, 0, test.config))
+
+			init := muxer.initSegment()
+			if init == nil {
+				t.Fatal("no init segment")
+			}
+
+			boxes := mp4TestBoxes(t, "", init)
+
+			tkhd := mp4TestFind(boxes, "/moov/trak/tkhd")
+			if len(tkhd) != 84 {
+				t.Fatalf("tkhd payload %d bytes, want 84", len(tkhd))
+			}
+
+			if width, height := int(binary.BigEndian.Uint32(tkhd[76:])>>16), int(binary.BigEndian.Uint32(tkhd[80:])>>16); width != test.width || height != test.height {
+				t.Errorf("tkhd %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+
+			sampleEntry := mp4TestFind(boxes, "/moov/trak/mdia/minf/stbl/stsd/"+test.sampleType)
+			if len(sampleEntry) < 78 {
+				t.Fatalf("no %s sample entry", test.sampleType)
+			}
+
+			if width, height := int(binary.BigEndian.Uint16(sampleEntry[24:])), int(binary.BigEndian.Uint16(sampleEntry[26:])); width != test.width || height != test.height {
+				t.Errorf("sample entry %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+
+			if mp4TestFind(boxes, "/moov/trak/mdia/minf/stbl/stsd/"+test.sampleType+"/"+test.recordType) == nil {
+				t.Errorf("no %s box", test.recordType)
+			}
+
+			if stsd := mp4TestFind(boxes, "/moov/trak/mdia/minf/stbl/stsd"); binary.BigEndian.Uint32(stsd[4:]) != 1 {
+				t.Errorf("stsd entry count %d, want 1", binary.BigEndian.Uint32(stsd[4:]))
+			}
+		})
+	}
+}
+
+func TestMp4FragmentSize(t *testing.T) {
+	config := append([]byte{0, 0, 0, 1}, h264TestSps(h264SpsTest{profileIdc: 66, pocType: 2, widthInMbs: 80, heightInMapUnit: 45, frameMbsOnly: true})...)
+	config = append(config, 0, 0, 0, 1, 0x68, 0xCE, 0x3C, 0x80)
+
+	tests := []struct {
+		name     string
+		payloads [][]byte
+	}{
+		{"single nal unit", [][]byte{{0, 0, 0, 1, 0x65, 0x88, 0x84}, {0, 0, 0, 1, 0x41, 0x9A}}},
+		{"multiple nal units", [][]byte{{0, 0, 0, 1, 0x06, 0x05, 0xFF, 0, 0, 1, 0x65, 0x88, 0x84, 0x21}, {0, 0, 1, 0x41, 0x9A, 0x02, 0, 0, 0, 1, 0x41, 0x9B}}},
+		{"large sample", [][]byte{append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0xAA}, 70000)...), {0, 0, 0, 1, 0x41, 0x9A}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			muxer := newMp4Muxer(false)
+			track := muxer.addVideoTrack(0x68323634, 1280, 720)
+			muxer.push(track, packetTest(true, false, 0, config))
+
+			var data []byte
+			for i, payload := range test.payloads {
+				data = append(data, muxer.push(track, packetTest(false, i == 0, uint64(i)*16666, payload))...)
+			}
+			data = append(data, muxer.flush(track)...)
+
+			boxes := mp4TestBoxes(t, "", data)
+
+			var moofs int
+			var offset int
+
+			for _, box := range boxes {
+				switch box.path {
+				case "/moof":
+					moofs++
+				case "/ftyp", "/moov":
+					offset += len(box.payload) + 8
+				case "/moof/traf/trun":
+					dataOffset := int(binary.BigEndian.Uint32(box.payload[8:]))
+					sampleSize := int(binary.BigEndian.Uint32(box.payload[16:]))
+
+					moofSize := int(binary.BigEndian.Uint32(data[offset:]))
+					if dataOffset != moofSize+8 {
+						t.Errorf("trun data offset %d, want %d", dataOffset, moofSize+8)
+					}
+
+					mdatSize := int(binary.BigEndian.Uint32(data[offset+moofSize:]))
+					if string(data[offset+moofSize+4:offset+moofSize+8]) != "mdat" {
+						t.Fatalf("no mdat after moof")
+					}
+
+					if sampleSize != mdatSize-8 {
+						t.Errorf("trun sample size %d, mdat payload %d", sampleSize, mdatSize-8)
+					}
+
+					offset += moofSize + mdatSize
+				}
+			}
+
+			if moofs != len(test.payloads) {
+				t.Errorf("%d fragments, want %d", moofs, len(test.payloads))
+			}
+
+			if offset != len(data) {
+				t.Errorf("fragments cover %d bytes, want %d", offset, len(data))
+			}
+		})
+	}
+}
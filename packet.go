@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+const packetSubscriberBufferSize = 256
+const packetKeyframeCacheSize = 1024
+
+type packetBroadcaster struct {
+	mutex           sync.Mutex
+	connected       chan struct{}
+	session         chan struct{}
+	subscribers     map[chan []byte]struct{}
+	keyframes       bool
+	configPacket    []byte
+	keyframePackets [][]byte
+}
+
+var videoBroadcaster = newPacketBroadcaster(true)
+var audioBroadcaster = newPacketBroadcaster(false)
+
+func newPacketBroadcaster(keyframes bool) *packetBroadcaster {
+	return &packetBroadcaster{
+		connected:   make(chan struct{}),
+		subscribers: make(map[chan []byte]struct{}),
+		keyframes:   keyframes,
+	}
+}
+
+func packetIsConfig(packet []byte) bool {
+	return packet[0]&0x80 != 0
+}
+
+func packetIsKeyframe(packet []byte) bool {
+	return packet[0]&0x40 != 0
+}
+
+func (b *packetBroadcaster) stop() {
+	if b.session == nil {
+		return
+	}
+
+	for c := range b.subscribers {
+		delete(b.subscribers, c)
+		close(c)
+	}
+
+	b.connected = make(chan struct{})
+	b.session = nil
+	b.configPacket = nil
+	b.keyframePackets = nil
+}
+
+func (b *packetBroadcaster) start() chan struct{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.stop()
+	session := b.connected
+	b.session = session
+	close(session)
+
+	return session
+}
+
+func (b *packetBroadcaster) end(session chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.session == session {
+		b.stop()
+	}
+}
+
+func (b *packetBroadcaster) broadcast(session chan struct{}, packet []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.session != session {
+		return false
+	}
+
+	if packetIsConfig(packet) {
+		b.configPacket = packet
+		b.keyframePackets = nil
+	} else if b.keyframes {
+		if packetIsKeyframe(packet) {
+			b.keyframePackets = [][]byte{packet}
+		} else if len(b.keyframePackets) >= packetKeyframeCacheSize {
+			b.keyframePackets = nil
+		} else if b.keyframePackets != nil {
+			b.keyframePackets = append(b.keyframePackets, packet)
+		}
+	}
+
+	for c := range b.subscribers {
+		select {
+		case c <- packet:
+		default:
+			delete(b.subscribers, c)
+			close(c)
+		}
+	}
+
+	return true
+}
+
+func (b *packetBroadcaster) run(socket net.Conn) {
+	session := b.start()
+
+	headerBytes := make([]byte, 12)
+	var n int
+	var err error
+	var packetSize int
+	var packet []byte
+
+	for {
+		n, err = io.ReadFull(socket, headerBytes)
+		if err != nil {
+			break
+		}
+		if n != 12 {
+			break
+		}
+
+		packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
+		packet = make([]byte, 12+packetSize)
+		copy(packet[:12], headerBytes)
+
+		n, err = io.ReadFull(socket, packet[12:])
+		if err != nil {
+			break
+		}
+		if n != packetSize {
+			break
+		}
+
+		if !b.broadcast(session, packet) {
+			return
+		}
+	}
+
+	b.end(session)
+}
+
+func (b *packetBroadcaster) subscribe(done <-chan struct{}) chan []byte {
+	for {
+		b.mutex.Lock()
+		connected := b.connected
+		b.mutex.Unlock()
+
+		select {
+		case <-connected:
+		case <-done:
+			return nil
+		}
+
+		b.mutex.Lock()
+
+		if b.session == connected {
+			c := make(chan []byte, packetSubscriberBufferSize+1+len(b.keyframePackets))
+
+			if b.configPacket != nil {
+				c <- b.configPacket
+			}
+
+			for _, packet := range b.keyframePackets {
+				c <- packet
+			}
+
+			b.subscribers[c] = struct{}{}
+			b.mutex.Unlock()
+			return c
+		}
+
+		b.mutex.Unlock()
+	}
+}
+
+func (b *packetBroadcaster) unsubscribe(c chan []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[c]; ok {
+		delete(b.subscribers, c)
+		close(c)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var recordCancel chan struct{}
+var recordDone chan struct{}
+var recordMutex sync.Mutex
+
+func recordStart(path string) bool {
+	if !config.Scrcpy.Video && !config.Scrcpy.Audio {
+		return false
+	}
+
+	var run func(w io.Writer, videoPackets chan []byte, audioPackets chan []byte, done <-chan struct{})
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mkv":
+		run = mkvRun
+	case ".mp4":
+		run = func(w io.Writer, videoPackets chan []byte, audioPackets chan []byte, done <-chan struct{}) {
+			mp4Run(w, videoPackets, audioPackets, true, done)
+		}
+	default:
+		return false
+	}
+
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	if recordDone != nil {
+		return false
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return false
+	}
+
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+
+	recordCancel = cancel
+	recordDone = done
+
+	go func() {
+		var videoPackets chan []byte
+		var audioPackets chan []byte
+
+		if config.Scrcpy.Video {
+			videoPackets = videoBroadcaster.subscribe(cancel)
+		}
+
+		if config.Scrcpy.Audio {
+			audioPackets = audioBroadcaster.subscribe(cancel)
+		}
+
+		if (!config.Scrcpy.Video || videoPackets != nil) && (!config.Scrcpy.Audio || audioPackets != nil) {
+			run(file, videoPackets, audioPackets, cancel)
+
+			select {
+			case <-cancel:
+			default:
+				fmt.Fprintln(os.Stderr, "recording of", path, "stopped before stoprecording")
+			}
+		}
+
+		if videoPackets != nil {
+			videoBroadcaster.unsubscribe(videoPackets)
+		}
+
+		if audioPackets != nil {
+			audioBroadcaster.unsubscribe(audioPackets)
+		}
+
+		file.Close()
+
+		recordMutex.Lock()
+		if recordCancel == cancel {
+			recordCancel = nil
+		}
+		recordDone = nil
+		recordMutex.Unlock()
+
+		close(done)
+	}()
+
+	return true
+}
+
+func recordStop() bool {
+	recordMutex.Lock()
+
+	if recordCancel == nil {
+		recordMutex.Unlock()
+		return false
+	}
+
+	close(recordCancel)
+	recordCancel = nil
+	done := recordDone
+
+	recordMutex.Unlock()
+
+	<-done
+
+	return true
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var replayVideoConfig []byte
+var replayVideoPackets [][]byte
+var replayAudioConfig []byte
+var replayAudioPackets [][]byte
+var replayMutex sync.Mutex
+
+func replayTrim() {
+	window := uint64(config.Replay.Duration) * 1000
+
+	if len(replayVideoPackets) > 0 {
+		newestPts := packetPts(replayVideoPackets[len(replayVideoPackets)-1])
+
+		if newestPts >= window {
+			start := 0
+			for i, packet := range replayVideoPackets {
+				if packetPts(packet) > newestPts-window {
+					break
+				}
+
+				if packetIsKeyframe(packet) {
+					start = i
+				}
+			}
+
+			if start > 0 {
+				replayVideoPackets = append([][]byte(nil), replayVideoPackets[start:]...)
+			}
+		}
+
+		startPts := packetPts(replayVideoPackets[0])
+
+		start := 0
+		for start < len(replayAudioPackets) && packetPts(replayAudioPackets[start]) < startPts {
+			start++
+		}
+
+		if start > 0 {
+			replayAudioPackets = append([][]byte(nil), replayAudioPackets[start:]...)
+		}
+	}
+
+	if len(replayAudioPackets) > 0 {
+		newestPts := packetPts(replayAudioPackets[len(replayAudioPackets)-1])
+		if newestPts < window {
+			return
+		}
+
+		start := 0
+		for start < len(replayAudioPackets) && packetPts(replayAudioPackets[start]) < newestPts-window {
+			start++
+		}
+
+		if start > 0 {
+			replayAudioPackets = append([][]byte(nil), replayAudioPackets[start:]...)
+		}
+	}
+}
+
+func replayCollect(broadcaster *packetBroadcaster, video bool) {
+	var lastTrim time.Time
+
+	for {
+		packets := broadcaster.subscribe(nil)
+
+		replayMutex.Lock()
+		if video {
+			replayVideoConfig = nil
+			replayVideoPackets = nil
+		} else {
+			replayAudioConfig = nil
+			replayAudioPackets = nil
+		}
+		replayMutex.Unlock()
+
+		for packet := range packets {
+			replayMutex.Lock()
+
+			if packetIsConfig(packet) {
+				if video {
+					if replayVideoConfig != nil && !bytes.Equal(replayVideoConfig[12:], packet[12:]) {
+						replayVideoPackets = nil
+						replayAudioPackets = nil
+					}
+
+					replayVideoConfig = packet
+				} else {
+					replayAudioConfig = packet
+				}
+			} else if video {
+				if replayVideoPackets != nil || packetIsKeyframe(packet) {
+					replayVideoPackets = append(replayVideoPackets, packet)
+				}
+			} else {
+				replayAudioPackets = append(replayAudioPackets, packet)
+			}
+
+			if (video && packetIsKeyframe(packet)) || time.Since(lastTrim) > time.Second {
+				replayTrim()
+				lastTrim = time.Now()
+			}
+
+			replayMutex.Unlock()
+		}
+	}
+}
+
+func replayWrite(w io.Writer, format string, duration time.Duration) bool {
+	if format != "mkv" && format != "mp4" {
+		return false
+	}
+
+	replayMutex.Lock()
+	videoConfig := replayVideoConfig
+	videoPackets := replayVideoPackets
+	audioConfig := replayAudioConfig
+	audioPackets := replayAudioPackets
+	replayMutex.Unlock()
+
+	if len(videoPackets) == 0 && len(audioPackets) == 0 {
+		return false
+	}
+
+	if duration > 0 {
+		window := uint64(duration / time.Microsecond)
+
+		if len(videoPackets) > 0 {
+			newestPts := packetPts(videoPackets[len(videoPackets)-1])
+
+			start := 0
+			for i, packet := range videoPackets {
+				if newestPts >= window && packetPts(packet) > newestPts-window {
+					break
+				}
+
+				if packetIsKeyframe(packet) {
+					start = i
+				}
+			}
+
+			videoPackets = videoPackets[start:]
+		} else {
+			newestPts := packetPts(audioPackets[len(audioPackets)-1])
+
+			start := 0
+			for start < len(audioPackets) && newestPts >= window && packetPts(audioPackets[start]) < newestPts-window {
+				start++
+			}
+
+			audioPackets = audioPackets[start:]
+		}
+	}
+
+	var push func(video bool, packet []byte) []byte
+	var finish func() []byte
+
+	if format == "mkv" {
+		muxer := newMkvMuxer()
+
+		var videoTrack *mkvTrack
+		var audioTrack *mkvTrack
+
+		if len(videoPackets) > 0 {
+			videoTrack = muxer.addVideoTrack(videoCodec, initialVideoWidth, initialVideoHeight)
+		}
+
+		if len(audioPackets) > 0 {
+			audioTrack = muxer.addAudioTrack(audioCodec)
+		}
+
+		push = func(video bool, packet []byte) []byte {
+			if video {
+				return muxer.push(videoTrack, packet)
+			}
+
+			return muxer.push(audioTrack, packet)
+		}
+
+		finish = func() []byte {
+			return nil
+		}
+	} else {
+		muxer := newMp4Muxer(true)
+
+		var videoTrack *mp4Track
+		var audioTrack *mp4Track
+
+		if len(videoPackets) > 0 {
+			videoTrack = muxer.addVideoTrack(videoCodec, initialVideoWidth, initialVideoHeight)
+		}
+
+		if len(audioPackets) > 0 {
+			audioTrack = muxer.addAudioTrack(audioCodec)
+		}
+
+		push = func(video bool, packet []byte) []byte {
+			if video {
+				return muxer.push(videoTrack, packet)
+			}
+
+			return muxer.push(audioTrack, packet)
+		}
+
+		finish = func() []byte {
+			var data []byte
+
+			for _, track := range muxer.tracks {
+				data = append(data, muxer.flush(track)...)
+			}
+
+			return data
+		}
+	}
+
+	var data []byte
+
+	if len(videoPackets) > 0 && videoConfig != nil {
+		data = append(data, push(true, videoConfig)...)
+	}
+
+	if len(audioPackets) > 0 && audioConfig != nil {
+		data = append(data, push(false, audioConfig)...)
+	}
+
+	for len(videoPackets) > 0 || len(audioPackets) > 0 {
+		if len(audioPackets) == 0 || (len(videoPackets) > 0 && packetPts(videoPackets[0]) <= packetPts(audioPackets[0])) {
+			data = append(data, push(true, videoPackets[0])...)
+			videoPackets = videoPackets[1:]
+		} else {
+			data = append(data, push(false, audioPackets[0])...)
+			audioPackets = audioPackets[1:]
+		}
+	}
+
+	data = append(data, finish()...)
+
+	n, err := w.Write(data)
+	if err != nil {
+		return false
+	}
+	if n != len(data) {
+		return false
+	}
+
+	return true
+}
+
+func replaySave(path string, duration time.Duration) bool {
+	if !config.Replay.Enabled {
+		return false
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if format != "mkv" && format != "mp4" {
+		return false
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return false
+	}
+
+	if !replayWrite(file, format, duration) {
+		file.Close()
+		os.Remove(path)
+		return false
+	}
+
+	return file.Close() == nil
+}
+
+func replaySend(w http.ResponseWriter, req *http.Request) {
+	if !config.Replay.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = "mkv"
+	}
+
+	var duration time.Duration
+	var err error
+
+	if query.Get("duration") != "" {
+		duration, err = time.ParseDuration(query.Get("duration"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var buffer bytes.Buffer
+
+	switch format {
+	case "mkv":
+		w.Header().Set("Content-Type", "video/x-matroska")
+	case "mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !replayWrite(&buffer, format, duration) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(buffer.Bytes())
+}
@@ -1,114 +1,97 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func videoSendStream(w http.ResponseWriter, req *http.Request, header bool) {
-	if !config.Scrcpy.Video || (config.VideoDecoder.Enabled && !config.VideoDecoder.Stream) {
+	if !config.Scrcpy.Video {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	select {
-	case <-videoConnectedChannel:
-	case <-req.Context().Done():
+	packets := videoBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
 		return
 	}
+	defer videoBroadcaster.unsubscribe(packets)
+
+	width, height := videoSizeGet()
 
 	if req.Header.Get("Origin") != "" {
-		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec, Initial-Width, Initial-Height")
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec, Initial-Width, Initial-Height, Width, Height")
 	}
 
 	w.Header().Set("Device-Name", deviceName)
 	w.Header().Set("Codec", strconv.FormatUint(uint64(videoCodec), 10))
 	w.Header().Set("Initial-Width", strconv.Itoa(initialVideoWidth))
 	w.Header().Set("Initial-Height", strconv.Itoa(initialVideoHeight))
+	w.Header().Set("Width", strconv.Itoa(width))
+	w.Header().Set("Height", strconv.Itoa(height))
 
-	headerBytes := make([]byte, 12)
-	var packetSize int
-	var packet []byte
+	var data []byte
 	var n int
 	var err error
 
-	if header {
-		var data []byte
-
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				break
-			}
-			if n != 12 {
-				break
-			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
+	for packet := range packets {
+		if header {
+			data = packet
+		} else {
+			data = packet[12:]
+		}
 
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				break
-			}
-			if n != packetSize {
-				break
-			}
+		n, err = w.Write(data)
+		if err != nil {
+			break
+		}
+		if n < len(data) {
+			break
+		}
 
-			data = make([]byte, 12+packetSize)
-			copy(data[:12], headerBytes)
-			copy(data[12:12+packetSize], packet)
+		w.(http.Flusher).Flush()
+	}
+}
 
-			n, err = w.Write(data)
-			if err != nil {
-				connectionControlChannel <- false
-				break
-			}
-			if n < 12+packetSize {
-				connectionControlChannel <- false
-				break
-			}
+func videoSendMp4Stream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-			w.(http.Flusher).Flush()
-		}
-	} else {
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				break
-			}
-			if n != 12 {
-				break
-			}
+	packets := videoBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
+		return
+	}
+	defer videoBroadcaster.unsubscribe(packets)
 
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
+	width, height := videoSizeGet()
 
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				break
-			}
-			if n != packetSize {
-				break
-			}
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec, Initial-Width, Initial-Height, Width, Height")
+	}
 
-			n, err = w.Write(packet)
-			if err != nil {
-				connectionControlChannel <- false
-				break
-			}
-			if n < packetSize {
-				connectionControlChannel <- false
-				break
-			}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Codec", strconv.FormatUint(uint64(videoCodec), 10))
+	w.Header().Set("Initial-Width", strconv.Itoa(initialVideoWidth))
+	w.Header().Set("Initial-Height", strconv.Itoa(initialVideoHeight))
+	w.Header().Set("Width", strconv.Itoa(width))
+	w.Header().Set("Height", strconv.Itoa(height))
 
-			w.(http.Flusher).Flush()
-		}
-	}
+	mp4Run(w, packets, nil, false, req.Context().Done())
 }
 
 func videoSendRgbStream(w http.ResponseWriter, req *http.Request) {
@@ -117,28 +100,50 @@ func videoSendRgbStream(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	select {
-	case <-videoConnectedChannel:
-	case <-req.Context().Done():
+	query := req.URL.Query()
+
+	crop, scaleWidth, scaleHeight, ok := videoParseTransform(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pixelFormat := config.VideoDecoder.PixelFormat
+	if query.Get("format") != "" {
+		pixelFormat = query.Get("format")
+	}
+
+	if _, ok := videoPixelFormats[pixelFormat]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	packets := videoBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
+		return
+	}
+	defer videoBroadcaster.unsubscribe(packets)
+
+	crop, outputWidth, outputHeight := videoTransformSize(initialVideoWidth, initialVideoHeight, crop, scaleWidth, scaleHeight)
+	if outputWidth == 0 || outputHeight == 0 {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	if req.Header.Get("Origin") != "" {
-		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height")
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height, Pixel-Format")
 	}
 
 	w.Header().Set("Device-Name", deviceName)
-	w.Header().Set("Width", strconv.Itoa(initialVideoWidth))
-	w.Header().Set("Height", strconv.Itoa(initialVideoHeight))
+	w.Header().Set("Width", strconv.Itoa(outputWidth))
+	w.Header().Set("Height", strconv.Itoa(outputHeight))
+	w.Header().Set("Pixel-Format", pixelFormat)
 
 	decoder := exec.Command(
 		config.VideoDecoder.Executable,
 		strconv.FormatUint(uint64(videoCodec), 10),
 		"1",
-		map[bool]string{
-			false: "0",
-			true:  "1",
-		}[config.VideoDecoder.Alpha],
+		pixelFormat,
 	)
 
 	decoder.Stderr = os.Stderr
@@ -158,87 +163,50 @@ func videoSendRgbStream(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	videoFrameSize := initialVideoWidth * initialVideoHeight * map[bool]int{
-		false: 3,
-		true:  4,
-	}[config.VideoDecoder.Alpha]
+	defer func() {
+		decoder.Process.Kill()
+		decoder.Wait()
+	}()
 
-	if len(videoFrame) != videoFrameSize {
-		videoFrame = make([]byte, videoFrameSize)
-	}
+	frameSize := videoPixelFormatSize(pixelFormat, initialVideoWidth, initialVideoHeight)
+	frame := make([]byte, frameSize)
+	output := make([]byte, videoPixelFormatSize(pixelFormat, outputWidth, outputHeight))
 
 	go func() {
-		headerBytes := make([]byte, 12)
 		var n int
 		var err error
-		var packetSize int
-		var packet []byte
-		var data []byte
-
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				decoder.Process.Kill()
-				decoder.Wait()
-				break
-			}
-			if n != 12 {
-				decoder.Process.Kill()
-				decoder.Wait()
-				break
-			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
-
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				break
-			}
-			if n != packetSize {
-				break
-			}
-
-			data = make([]byte, 12+packetSize)
-			copy(data[:12], headerBytes)
-			copy(data[12:12+packetSize], packet)
 
-			n, err = decoderStdin.Write(data)
+		for packet := range packets {
+			n, err = decoderStdin.Write(packet)
 			if err != nil {
-				connectionControlChannel <- false
 				break
 			}
-			if n < 12+packetSize {
-				connectionControlChannel <- false
+			if n < len(packet) {
 				break
 			}
 		}
+
+		decoderStdin.Close()
 	}()
 
 	var n int
 
 	for {
-		n, err = io.ReadFull(decoderStdout, videoFrame)
+		n, err = io.ReadFull(decoderStdout, frame)
 		if err != nil {
-			connectionControlChannel <- false
 			break
 		}
-		if n != videoFrameSize {
-			connectionControlChannel <- false
+		if n != frameSize {
 			break
 		}
 
-		n, err = w.Write(videoFrame)
+		data := videoTransformFrame(output, frame, pixelFormat, initialVideoWidth, initialVideoHeight, crop, outputWidth, outputHeight)
+
+		n, err = w.Write(data)
 		if err != nil {
-			decoder.Process.Kill()
-			decoder.Wait()
-			connectionControlChannel <- false
 			break
 		}
-		if n < videoFrameSize {
-			decoder.Process.Kill()
-			decoder.Wait()
-			connectionControlChannel <- false
+		if n < len(data) {
 			break
 		}
 
@@ -252,458 +220,798 @@ func videoSendFfmpegRgbStream(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	select {
-	case <-videoConnectedChannel:
-	case <-req.Context().Done():
+	query := req.URL.Query()
+
+	requestCrop, scaleWidth, scaleHeight, ok := videoParseTransform(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if req.Header.Get("Origin") != "" {
-		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height")
+	pixelFormat := config.VideoDecoder.PixelFormat
+	if query.Get("format") != "" {
+		pixelFormat = query.Get("format")
 	}
 
-	w.Header().Set("Device-Name", deviceName)
-	w.Header().Set("Width", strconv.Itoa(initialVideoWidth))
-	w.Header().Set("Height", strconv.Itoa(initialVideoHeight))
-
-	ffmpeg := exec.Command(
-		config.VideoDecoder.Executable,
-		"-probesize",
-		"32",
-		"-analyzeduration",
-		"0",
-		"-re",
-		"-f",
-		map[uint32]string{
-			0x68323634: "h264",
-			0x68323635: "hevc",
-			0x617631:   "av1",
-		}[videoCodec],
-		"-i",
-		"-",
-		"-f",
-		"rawvideo",
-		"-pix_fmt",
-		map[bool]string{
-			false: "rgb24",
-			true:  "rgba",
-		}[config.VideoDecoder.Alpha],
-		"-vf",
-		func() string {
-			if initialVideoWidth >= initialVideoHeight {
-				return "transpose=1:landscape"
-			}
-
-			return "transpose=1:portrait"
-		}(),
-		"-",
-	)
-
-	ffmpeg.Stderr = os.Stderr
-
-	ffmpegStdin, err := ffmpeg.StdinPipe()
-	if err != nil {
+	if _, ok := videoPixelFormats[pixelFormat]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	ffmpegStdout, err := ffmpeg.StdoutPipe()
-	if err != nil {
+	packets := videoBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
 		return
 	}
+	defer videoBroadcaster.unsubscribe(packets)
 
-	err = ffmpeg.Start()
-	if err != nil {
-		return
+	width, height := videoSizeGet()
+	if width == 0 || height == 0 {
+		width = initialVideoWidth
+		height = initialVideoHeight
 	}
 
-	videoFrameSize := initialVideoWidth * initialVideoHeight * map[bool]int{
-		false: 3,
-		true:  4,
-	}[config.VideoDecoder.Alpha]
-
-	if len(videoFrame) != videoFrameSize {
-		videoFrame = make([]byte, videoFrameSize)
+	_, outputWidth, outputHeight := videoTransformSize(width, height, requestCrop, scaleWidth, scaleHeight)
+	if outputWidth == 0 || outputHeight == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	go func() {
-		headerBytes := make([]byte, 12)
-		var n int
-		var err error
-		var packetSize int
-		var packet []byte
-
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				break
-			}
-			if n != 12 {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				break
-			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
-
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				break
-			}
-			if n != packetSize {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				break
-			}
-
-			n, err = ffmpegStdin.Write(packet)
-			if err != nil {
-				connectionControlChannel <- false
-				break
-			}
-			if n < packetSize {
-				connectionControlChannel <- false
-				break
-			}
-		}
-	}()
-
-	var n int
-
-	for {
-		n, err = io.ReadFull(ffmpegStdout, videoFrame)
-		if err != nil {
-			connectionControlChannel <- false
-			break
-		}
-		if n != videoFrameSize {
-			connectionControlChannel <- false
-			break
-		}
-
-		n, err = w.Write(videoFrame)
-		if err != nil {
-			ffmpeg.Process.Kill()
-			ffmpeg.Wait()
-			connectionControlChannel <- false
-			break
-		}
-		if n < videoFrameSize {
-			ffmpeg.Process.Kill()
-			ffmpeg.Wait()
-			connectionControlChannel <- false
-			break
-		}
-
-		w.(http.Flusher).Flush()
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height, Pixel-Format")
 	}
-}
 
-func videoDecode() {
-	var err error
-	var decoder *exec.Cmd
-	var decoderStdin io.WriteCloser
-	var decoderStdout io.ReadCloser
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Width", strconv.Itoa(outputWidth))
+	w.Header().Set("Height", strconv.Itoa(outputHeight))
+	w.Header().Set("Pixel-Format", pixelFormat)
 
-	for {
-		<-videoConnectedChannel
+	output := make([]byte, videoPixelFormatSize(pixelFormat, outputWidth, outputHeight))
 
-		if decoder != nil {
-			decoder.Process.Kill()
-			decoder.Wait()
+	videoFfmpegSplit(packets, width, height, func(segment chan []byte, width int, height int) bool {
+		crop, segmentOutputWidth, segmentOutputHeight := videoTransformSize(width, height, requestCrop, scaleWidth, scaleHeight)
+		if segmentOutputWidth != outputWidth || segmentOutputHeight != outputHeight {
+			return true
 		}
 
-		decoder = exec.Command(
-			config.VideoDecoder.Executable,
-			strconv.FormatUint(uint64(videoCodec), 10),
-			"0",
-			map[bool]string{
-				false: "0",
-				true:  "1",
-			}[config.VideoDecoder.Alpha],
-		)
+		ffmpeg := videoFfmpegCommand(pixelFormat)
 
-		decoder.Stderr = os.Stderr
+		ffmpeg.Stderr = os.Stderr
 
-		decoderStdin, err = decoder.StdinPipe()
+		ffmpegStdin, err := ffmpeg.StdinPipe()
 		if err != nil {
-			return
+			return true
 		}
 
-		decoderStdout, err = decoder.StdoutPipe()
+		ffmpegStdout, err := ffmpeg.StdoutPipe()
 		if err != nil {
-			return
+			return true
 		}
 
-		err = decoder.Start()
+		err = ffmpeg.Start()
 		if err != nil {
-			return
+			return true
 		}
 
+		defer func() {
+			ffmpeg.Process.Kill()
+			ffmpeg.Wait()
+		}()
+
 		go func() {
-			data := make([]byte, 8)
 			var n int
 			var err error
-			var frame []byte
-			var frameWidth int
-			var frameWidth2 int
-			var frameHeight int
-			var frameHeight2 int
-			var frameSize int
-			var frameSize2 int
-
-			for {
-				n, err = io.ReadFull(decoderStdout, data)
-				if err != nil {
-					break
-				}
-				if n != 8 {
-					break
-				}
-
-				frameWidth2 = int(binary.NativeEndian.Uint32(data[:4]))
-				frameHeight2 = int(binary.NativeEndian.Uint32(data[4:]))
-
-				if frameWidth != frameWidth2 || frameHeight != frameHeight2 {
-					frameWidth = frameWidth2
-					frameHeight = frameHeight2
 
-					frameSize2 = frameWidth * frameHeight * map[bool]int{
-						false: 3,
-						true:  4,
-					}[config.VideoDecoder.Alpha]
-
-					if frameSize != frameSize2 {
-						frame = make([]byte, frameSize2)
-						frameSize = frameSize2
-					}
-				}
-
-				n, err = io.ReadFull(decoderStdout, frame)
+			for packet := range segment {
+				n, err = ffmpegStdin.Write(packet[12:])
 				if err != nil {
 					break
 				}
-				if n != frameSize {
+				if n < len(packet)-12 {
 					break
 				}
+			}
 
-				videoFrameMutex.Lock()
-
-				if videoFrameWidth != frameWidth || videoFrameHeight != frameHeight {
-					videoFrameWidth = frameWidth
-					videoFrameHeight = frameHeight
-					videoFrame = make([]byte, frameSize)
-				}
-
-				copy(videoFrame, frame)
+			ffmpegStdin.Close()
 
-				videoFrameMutex.Unlock()
+			for range segment {
 			}
 		}()
 
-		headerBytes := make([]byte, 12)
+		frameSize := videoPixelFormatSize(pixelFormat, width, height)
+		frame := make([]byte, frameSize)
 		var n int
-		var packetSize int
-		var packet []byte
-		var data []byte
 
 		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				break
-			}
-			if n != 12 {
-				break
+			n, err = io.ReadFull(ffmpegStdout, frame)
+			if err == io.EOF {
+				return false
 			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
-
-			n, err = io.ReadFull(videoSocket, packet)
 			if err != nil {
-				break
+				return true
 			}
-			if n != packetSize {
-				break
+			if n != frameSize {
+				return true
 			}
 
-			data = make([]byte, 12+packetSize)
-			copy(data[:12], headerBytes)
-			copy(data[12:12+packetSize], packet)
+			data := videoTransformFrame(output, frame, pixelFormat, width, height, crop, outputWidth, outputHeight)
 
-			n, err = decoderStdin.Write(data)
+			n, err = w.Write(data)
 			if err != nil {
-				connectionControlChannel <- false
-				break
+				return true
 			}
-			if n < 12+packetSize {
-				connectionControlChannel <- false
-				break
+			if n < len(data) {
+				return true
 			}
+
+			w.(http.Flusher).Flush()
 		}
-	}
+	})
 }
 
-func videoDecodeFfmpeg() {
-	var err error
-	var ffmpeg *exec.Cmd
-	var ffmpegStdin io.WriteCloser
-	var ffmpegStdout io.ReadCloser
+func videoFrameSet(frame []byte, width int, height int, pts uint64) {
+	videoFrameMutex.Lock()
 
-	for {
-		<-videoConnectedChannel
+	if videoFrameWidth != width || videoFrameHeight != height || len(videoFrame) != len(frame) {
+		videoFrameWidth = width
+		videoFrameHeight = height
+		videoFrame = make([]byte, len(frame))
+	}
 
-		videoFrameSize := initialVideoWidth * initialVideoHeight * map[bool]int{
-			false: 3,
-			true:  4,
-		}[config.VideoDecoder.Alpha]
+	copy(videoFrame, frame)
+	videoFrameSequence++
+	videoFramePts = pts
+	close(videoFrameUpdated)
+	videoFrameUpdated = make(chan struct{})
 
-		videoFrameMutex.Lock()
-		videoFrameWidth = initialVideoWidth
-		videoFrameHeight = initialVideoHeight
-		if len(videoFrame) != videoFrameSize {
-			videoFrame = make([]byte, videoFrameSize)
-		}
-		videoFrameMutex.Unlock()
+	videoFrameMutex.Unlock()
 
-		if ffmpeg != nil {
-			ffmpeg.Process.Kill()
-			ffmpeg.Wait()
-		}
+	if config.ChangeDetection.Enabled {
+		changeUpdate(frame, width, height)
+	}
+}
 
-		ffmpeg = exec.Command(
+func videoDecode() {
+	for {
+		packets := videoBroadcaster.subscribe(nil)
+
+		decoder := exec.Command(
 			config.VideoDecoder.Executable,
-			"-probesize",
-			"32",
-			"-analyzeduration",
+			strconv.FormatUint(uint64(videoCodec), 10),
 			"0",
-			"-re",
-			"-f",
-			map[uint32]string{
-				0x68323634: "h264",
-				0x68323635: "hevc",
-				0x617631:   "av1",
-			}[videoCodec],
-			"-i",
-			"-",
-			"-f",
-			"rawvideo",
-			"-pix_fmt",
-			map[bool]string{
-				false: "rgb24",
-				true:  "rgba",
-			}[config.VideoDecoder.Alpha],
-			"-vf",
-			func() string {
-				if initialVideoWidth >= initialVideoHeight {
-					return "transpose=1:landscape"
-				}
-
-				return "transpose=1:portrait"
-			}(),
-			"-",
+			config.VideoDecoder.PixelFormat,
 		)
 
-		ffmpeg.Stderr = os.Stderr
-
-		ffmpegStdin, err = ffmpeg.StdinPipe()
-		if err != nil {
-			return
+		if videoDecoderRun(packets, decoder, true, videoDecodeRead) {
+			videoBroadcaster.unsubscribe(packets)
 		}
+	}
+}
 
-		ffmpegStdout, err = ffmpeg.StdoutPipe()
-		if err != nil {
-			return
-		}
+func videoDecodeRead(stdout io.Reader) {
+	data := make([]byte, 16)
+	var n int
+	var err error
+	var framePts uint64
+	var frame []byte
+	var frameWidth int
+	var frameWidth2 int
+	var frameHeight int
+	var frameHeight2 int
+	var frameSize int
+	var frameSize2 int
 
-		err = ffmpeg.Start()
+	for {
+		n, err = io.ReadFull(stdout, data)
 		if err != nil {
-			return
+			break
+		}
+		if n != 16 {
+			break
 		}
 
-		go func() {
-			var n int
-			var err error
+		frameWidth2 = int(binary.NativeEndian.Uint32(data[:4]))
+		frameHeight2 = int(binary.NativeEndian.Uint32(data[4:8]))
+		framePts = binary.NativeEndian.Uint64(data[8:])
 
-			videoFrameMutex.RLock()
-			frame := make([]byte, len(videoFrame))
-			videoFrameMutex.RUnlock()
+		if frameWidth != frameWidth2 || frameHeight != frameHeight2 {
+			frameWidth = frameWidth2
+			frameHeight = frameHeight2
 
-			for {
-				n, err = io.ReadFull(ffmpegStdout, frame)
-				if err != nil {
-					break
+			frameSize2 = videoPixelFormatSize(config.VideoDecoder.PixelFormat, frameWidth, frameHeight)
+
+			if frameSize != frameSize2 {
+				frame = make([]byte, frameSize2)
+				frameSize = frameSize2
+			}
+		}
+
+		n, err = io.ReadFull(stdout, frame)
+		if err != nil {
+			break
+		}
+		if n != frameSize {
+			break
+		}
+
+		videoFrameSet(frame, frameWidth, frameHeight, framePts)
+	}
+}
+
+func videoDecodeFfmpeg() {
+	for {
+		packets := videoBroadcaster.subscribe(nil)
+
+		width, height := videoSizeGet()
+		if width == 0 || height == 0 {
+			width = initialVideoWidth
+			height = initialVideoHeight
+		}
+
+		crashed := videoFfmpegSplit(packets, width, height, func(segment chan []byte, width int, height int) bool {
+			return videoDecoderRun(segment, videoFfmpegCommand(config.VideoDecoder.PixelFormat), false, func(stdout io.Reader) {
+				videoDecodeFfmpegRead(stdout, width, height)
+			})
+		})
+
+		if crashed {
+			videoBroadcaster.unsubscribe(packets)
+		}
+	}
+}
+
+func videoDecodeFfmpegRead(stdout io.Reader, width int, height int) {
+	frameSize := videoPixelFormatSize(config.VideoDecoder.PixelFormat, width, height)
+	frame := make([]byte, frameSize)
+
+	for {
+		n, err := io.ReadFull(stdout, frame)
+		if err != nil {
+			break
+		}
+		if n != frameSize {
+			break
+		}
+
+		videoFrameSet(frame, width, height, 0)
+	}
+}
+
+func videoFfmpegSplit(packets chan []byte, width int, height int, run func(chan []byte, int, int) bool) bool {
+	var segment chan []byte
+	var result chan bool
+
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				if segment == nil {
+					return false
 				}
-				if n != len(frame) {
-					break
+
+				close(segment)
+				return <-result
+			}
+
+			if packetIsConfig(packet) {
+				configWidth, configHeight, ok := videoConfigSize(videoCodec, packet[12:])
+
+				if ok && (configWidth != width || configHeight != height) {
+					width = configWidth
+					height = configHeight
+
+					if segment != nil {
+						close(segment)
+
+						if <-result {
+							return true
+						}
+
+						segment = nil
+					}
 				}
+			}
+
+			if segment == nil {
+				segment = make(chan []byte, packetSubscriberBufferSize)
+				result = make(chan bool, 1)
 
-				videoFrameMutex.Lock()
-				copy(videoFrame, frame)
-				videoFrameMutex.Unlock()
+				go func(segment chan []byte, result chan bool, width int, height int) {
+					result <- run(segment, width, height)
+				}(segment, result, width, height)
 			}
-		}()
 
-		headerBytes := make([]byte, 12)
-		var n int
-		var packetSize int
-		var packet []byte
+			select {
+			case segment <- packet:
+			case <-result:
+				close(segment)
+				return true
+			}
+		case <-result:
+			close(segment)
+			return true
+		}
+	}
+}
 
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				ffmpeg = nil
-				break
+func videoSendCgoRgbStream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || !config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	requestCrop, scaleWidth, scaleHeight, ok := videoParseTransform(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pixelFormat := config.VideoDecoder.PixelFormat
+	if query.Get("format") != "" {
+		pixelFormat = query.Get("format")
+	}
+
+	if _, ok := videoPixelFormats[pixelFormat]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	packets := videoBroadcaster.subscribe(req.Context().Done())
+	if packets == nil {
+		return
+	}
+	defer videoBroadcaster.unsubscribe(packets)
+
+	currentWidth, currentHeight := videoSizeGet()
+	if currentWidth == 0 || currentHeight == 0 {
+		currentWidth = initialVideoWidth
+		currentHeight = initialVideoHeight
+	}
+
+	crop, outputWidth, outputHeight := videoTransformSize(currentWidth, currentHeight, requestCrop, scaleWidth, scaleHeight)
+	if outputWidth == 0 || outputHeight == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	decoder := videoCgoDecoderNew(videoCodec, pixelFormat)
+	if decoder == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer decoder.close()
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height, Pixel-Format")
+	}
+
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Width", strconv.Itoa(outputWidth))
+	w.Header().Set("Height", strconv.Itoa(outputHeight))
+	w.Header().Set("Pixel-Format", pixelFormat)
+
+	output := make([]byte, videoPixelFormatSize(pixelFormat, outputWidth, outputHeight))
+	failed := false
+
+	for packet := range packets {
+		ok = decoder.decode(packet, func(frame []byte, width int, height int, pts uint64) {
+			if failed {
+				return
 			}
-			if n != 12 {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				ffmpeg = nil
+
+			if width != currentWidth || height != currentHeight {
+				var frameOutputWidth int
+				var frameOutputHeight int
+
+				crop, frameOutputWidth, frameOutputHeight = videoTransformSize(width, height, requestCrop, scaleWidth, scaleHeight)
+				if frameOutputWidth != outputWidth || frameOutputHeight != outputHeight {
+					failed = true
+					return
+				}
+
+				currentWidth = width
+				currentHeight = height
+			}
+
+			data := videoTransformFrame(output, frame, pixelFormat, width, height, crop, outputWidth, outputHeight)
+
+			n, err := w.Write(data)
+			if err != nil || n < len(data) {
+				failed = true
+				return
+			}
+
+			w.(http.Flusher).Flush()
+		})
+
+		if !ok || failed {
+			break
+		}
+	}
+}
+
+func videoDecodeCgo() {
+	for {
+		packets := videoBroadcaster.subscribe(nil)
+
+		decoder := videoCgoDecoderNew(videoCodec, config.VideoDecoder.PixelFormat)
+		if decoder == nil {
+			videoBroadcaster.unsubscribe(packets)
+			videoDecoderExited(videoDecoderDecodeError, true)
+			continue
+		}
+
+		videoDecoderStarted()
+		crashed := false
+
+		for packet := range packets {
+			if !decoder.decode(packet, videoFrameSet) {
+				videoBroadcaster.unsubscribe(packets)
+				crashed = true
 				break
 			}
+		}
+
+		decoder.close()
+
+		if crashed {
+			videoDecoderExited(videoDecoderDecodeError, true)
+		} else {
+			videoDecoderExited(nil, false)
+		}
+	}
+}
+
+func videoFfmpegCommand(pixelFormat string) *exec.Cmd {
+	return exec.Command(
+		config.VideoDecoder.Executable,
+		"-probesize",
+		"32",
+		"-analyzeduration",
+		"0",
+		"-re",
+		"-f",
+		map[uint32]string{
+			0x68323634: "h264",
+			0x68323635: "hevc",
+			0x617631:   "av1",
+		}[videoCodec],
+		"-i",
+		"-",
+		"-f",
+		"rawvideo",
+		"-pix_fmt",
+		videoPixelFormats[pixelFormat],
+		"-",
+	)
+}
+
+func videoSendFrame(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	crop, scaleWidth, scaleHeight, ok := videoParseTransform(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pixelFormat := config.VideoDecoder.PixelFormat
+	if query.Get("format") != "" {
+		pixelFormat = query.Get("format")
+	}
+
+	if _, ok := videoPixelFormats[pixelFormat]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	variant := pixelFormat + "-" + query.Get("crop") + "-" + query.Get("scale")
+
+	var after uint64
+	var afterSet bool
+	timeout := 30 * time.Second
+	var err error
+
+	if query.Get("after") != "" {
+		after, err = strconv.ParseUint(query.Get("after"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		afterSet = true
+	} else if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		sequence, tagVariant, _ := strings.Cut(strings.Trim(strings.TrimPrefix(ifNoneMatch, "W/"), "\""), "-")
+
+		after, err = strconv.ParseUint(sequence, 10, 64)
+		afterSet = err == nil && tagVariant == variant
+	}
+
+	if query.Get("timeout") != "" {
+		timeout, err = time.ParseDuration(query.Get("timeout"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	deadline := time.After(timeout)
+
+	videoFrameMutex.RLock()
+
+	for afterSet && videoFrameSequence <= after {
+		updated := videoFrameUpdated
+		videoFrameMutex.RUnlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			w.Header().Set("ETag", fmt.Sprintf("\"%d-%s\"", after, variant))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-req.Context().Done():
+			return
+		}
+
+		videoFrameMutex.RLock()
+	}
+
+	defer videoFrameMutex.RUnlock()
+
+	if len(videoFrame) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	crop, outputWidth, outputHeight := videoTransformSize(videoFrameWidth, videoFrameHeight, crop, scaleWidth, scaleHeight)
+	if outputWidth == 0 || outputHeight == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := videoTransformFrame(make([]byte, videoPixelFormatSize(config.VideoDecoder.PixelFormat, outputWidth, outputHeight)), videoFrame, config.VideoDecoder.PixelFormat, videoFrameWidth, videoFrameHeight, crop, outputWidth, outputHeight)
+
+	if pixelFormat != config.VideoDecoder.PixelFormat {
+		data = videoConvertFrame(videoFrameToImage(data, config.VideoDecoder.PixelFormat, outputWidth, outputHeight), pixelFormat)
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height, Pixel-Format, Frame-Sequence, Frame-Pts, ETag")
+	}
 
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Width", strconv.Itoa(outputWidth))
+	w.Header().Set("Height", strconv.Itoa(outputHeight))
+	w.Header().Set("Pixel-Format", pixelFormat)
+	w.Header().Set("Frame-Sequence", strconv.FormatUint(videoFrameSequence, 10))
+	if videoFramePts != 0 {
+		w.Header().Set("Frame-Pts", strconv.FormatUint(videoFramePts, 10))
+	}
+	w.Header().Set("ETag", fmt.Sprintf("\"%d-%s\"", videoFrameSequence, variant))
+	w.Write(data)
+}
+
+func videoFrameImage() (*image.RGBA, chan struct{}) {
+	videoFrameMutex.RLock()
+	defer videoFrameMutex.RUnlock()
 
-			n, err = io.ReadFull(videoSocket, packet)
+	if len(videoFrame) == 0 || videoFrameWidth == 0 || videoFrameHeight == 0 {
+		return nil, videoFrameUpdated
+	}
+
+	return videoFrameToImage(videoFrame, config.VideoDecoder.PixelFormat, videoFrameWidth, videoFrameHeight), videoFrameUpdated
+}
+
+func videoSendMjpegStream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	quality := jpeg.DefaultQuality
+	var interval time.Duration
+
+	if query.Get("quality") != "" {
+		var err error
+
+		quality, err = strconv.Atoi(query.Get("quality"))
+		if err != nil || quality < 1 || quality > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Get("fps") != "" {
+		fps, err := strconv.ParseFloat(query.Get("fps"), 64)
+		if err != nil || fps <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		interval = time.Duration(float64(time.Second) / fps)
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name")
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+	w.Header().Set("Device-Name", deviceName)
+
+	var b bytes.Buffer
+	var lastFrame time.Time
+	var err error
+
+	for {
+		img, updated := videoFrameImage()
+
+		if img != nil {
+			b.Reset()
+
+			err = jpeg.Encode(&b, img, &jpeg.Options{Quality: quality})
 			if err != nil {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				ffmpeg = nil
-				break
+				return
 			}
-			if n != packetSize {
-				ffmpeg.Process.Kill()
-				ffmpeg.Wait()
-				ffmpeg = nil
-				break
+
+			_, err = fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", b.Len())
+			if err != nil {
+				return
 			}
 
-			n, err = ffmpegStdin.Write(packet)
+			b.WriteString("\r\n")
+
+			_, err = b.WriteTo(w)
 			if err != nil {
-				connectionControlChannel <- false
-				break
+				return
+			}
+
+			w.(http.Flusher).Flush()
+			lastFrame = time.Now()
+		}
+
+		select {
+		case <-updated:
+		case <-req.Context().Done():
+			return
+		}
+
+		if interval > 0 {
+			select {
+			case <-time.After(time.Until(lastFrame.Add(interval))):
+			case <-req.Context().Done():
+				return
 			}
-			if n < packetSize {
-				connectionControlChannel <- false
+		}
+	}
+}
+
+func videoSendSnapshot(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	format := query.Get("format")
+
+	if format == "" {
+		for _, mediaRange := range strings.Split(req.Header.Get("Accept"), ",") {
+			switch strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0]) {
+			case "image/png":
+				format = "png"
+			case "image/jpeg":
+				format = "jpeg"
+			case "image/webp":
+				format = "webp"
+			}
+
+			if format != "" {
 				break
 			}
 		}
+
+		if format == "" {
+			format = "png"
+		}
 	}
+
+	quality := jpeg.DefaultQuality
+
+	if query.Get("quality") != "" {
+		var err error
+
+		quality, err = strconv.Atoi(query.Get("quality"))
+		if err != nil || quality < 1 || quality > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	img, _ := videoFrameImage()
+	if img == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var b bytes.Buffer
+	var err error
+
+	switch format {
+	case "png":
+		w.Header().Set("Content-Type", "image/png")
+		err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&b, img)
+	case "jpeg", "jpg":
+		w.Header().Set("Content-Type", "image/jpeg")
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: quality})
+	case "webp":
+		w.Header().Set("Content-Type", "image/webp")
+		err = webpEncode(&b, img)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height")
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Device-Name", deviceName)
+	w.Header().Set("Width", strconv.Itoa(img.Rect.Dx()))
+	w.Header().Set("Height", strconv.Itoa(img.Rect.Dy()))
+	w.Write(b.Bytes())
 }
 
-func videoSendFrame(w http.ResponseWriter, req *http.Request) {
+func videoSendPixels(w http.ResponseWriter, req *http.Request) {
 	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	query := req.URL.Query()
+
+	if len(query["point"]) == 0 && len(query["rect"]) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var points [][]int
+	var rects []image.Rectangle
+
+	for _, value := range query["point"] {
+		numbers, ok := videoParseNumbers(value, 2)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		points = append(points, numbers)
+	}
+
+	for _, value := range query["rect"] {
+		numbers, ok := videoParseNumbers(value, 4)
+		if !ok || numbers[2] == 0 || numbers[3] == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rects = append(rects, image.Rect(numbers[0], numbers[1], numbers[0]+numbers[2], numbers[1]+numbers[3]))
+	}
+
 	videoFrameMutex.RLock()
 	defer videoFrameMutex.RUnlock()
 
@@ -712,13 +1020,344 @@ func videoSendFrame(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	bounds := image.Rect(0, 0, videoFrameWidth, videoFrameHeight)
+
+	var response strings.Builder
+
+	response.WriteString("{\"points\":[")
+
+	for i, point := range points {
+		if !image.Pt(point[0], point[1]).In(bounds) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if i > 0 {
+			response.WriteString(",")
+		}
+
+		r, g, b, a := videoFramePixel(videoFrame, config.VideoDecoder.PixelFormat, videoFrameWidth, videoFrameHeight, point[0], point[1])
+		fmt.Fprintf(&response, "[%d,%d,%d,%d]", r, g, b, a)
+	}
+
+	response.WriteString("],\"rects\":[")
+
+	for i, rect := range rects {
+		if !rect.In(bounds) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if i > 0 {
+			response.WriteString(",")
+		}
+
+		var sums [4]int
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				r, g, b, a := videoFramePixel(videoFrame, config.VideoDecoder.PixelFormat, videoFrameWidth, videoFrameHeight, x, y)
+				sums[0] += int(r)
+				sums[1] += int(g)
+				sums[2] += int(b)
+				sums[3] += int(a)
+			}
+		}
+
+		count := rect.Dx() * rect.Dy()
+		fmt.Fprintf(&response, "[%d,%d,%d,%d]", (sums[0]+count/2)/count, (sums[1]+count/2)/count, (sums[2]+count/2)/count, (sums[3]+count/2)/count)
+	}
+
+	response.WriteString("]}")
+
 	if req.Header.Get("Origin") != "" {
-		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height")
+		w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height, Frame-Sequence")
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Device-Name", deviceName)
 	w.Header().Set("Width", strconv.Itoa(videoFrameWidth))
 	w.Header().Set("Height", strconv.Itoa(videoFrameHeight))
-	w.Write(videoFrame)
+	w.Header().Set("Frame-Sequence", strconv.FormatUint(videoFrameSequence, 10))
+	w.Write([]byte(response.String()))
+}
+
+func videoParseNumbers(value string, count int) ([]int, bool) {
+	values := strings.Split(value, ",")
+	if len(values) != count {
+		return nil, false
+	}
+
+	numbers := make([]int, count)
+
+	for i, value := range values {
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || number < 0 {
+			return nil, false
+		}
+
+		numbers[i] = number
+	}
+
+	return numbers, true
+}
+
+func videoParseTransform(query url.Values) (image.Rectangle, int, int, bool) {
+	var crop image.Rectangle
+	var scaleWidth int
+	var scaleHeight int
+
+	if query.Get("crop") != "" {
+		numbers, ok := videoParseNumbers(query.Get("crop"), 4)
+		if !ok || numbers[2] == 0 || numbers[3] == 0 {
+			return crop, 0, 0, false
+		}
+
+		crop = image.Rect(numbers[0], numbers[1], numbers[0]+numbers[2], numbers[1]+numbers[3])
+	}
+
+	if query.Get("scale") != "" {
+		numbers, ok := videoParseNumbers(query.Get("scale"), 2)
+		if !ok || (numbers[0] == 0 && numbers[1] == 0) {
+			return crop, 0, 0, false
+		}
+
+		scaleWidth = numbers[0]
+		scaleHeight = numbers[1]
+	}
+
+	return crop, scaleWidth, scaleHeight, true
+}
+
+func videoTransformSize(width int, height int, crop image.Rectangle, scaleWidth int, scaleHeight int) (image.Rectangle, int, int) {
+	bounds := image.Rect(0, 0, width, height)
+
+	if crop.Empty() {
+		crop = bounds
+	} else {
+		crop = crop.Intersect(bounds)
+		if crop.Empty() {
+			return crop, 0, 0
+		}
+	}
+
+	outputWidth := crop.Dx()
+	outputHeight := crop.Dy()
+
+	if scaleWidth > 0 && scaleHeight > 0 {
+		outputWidth = scaleWidth
+		outputHeight = scaleHeight
+	} else if scaleWidth > 0 {
+		outputHeight = (crop.Dy()*scaleWidth + crop.Dx()/2) / crop.Dx()
+		outputWidth = scaleWidth
+	} else if scaleHeight > 0 {
+		outputWidth = (crop.Dx()*scaleHeight + crop.Dy()/2) / crop.Dy()
+		outputHeight = scaleHeight
+	}
+
+	if outputWidth < 1 {
+		outputWidth = 1
+	}
+
+	if outputHeight < 1 {
+		outputHeight = 1
+	}
+
+	return crop, outputWidth, outputHeight
+}
+
+func videoPixelFormatSize(format string, width int, height int) int {
+	switch format {
+	case "gray8":
+		return width * height
+	case "rgb24":
+		return width * height * 3
+	case "yuv420p":
+		return width*height + 2*((width+1)/2)*((height+1)/2)
+	}
+
+	return width * height * 4
+}
+
+func videoTransformPlane(dst []byte, src []byte, stride int, pixelSize int, crop image.Rectangle, outputWidth int, outputHeight int) {
+	outputStride := outputWidth * pixelSize
+
+	for y := 0; y < outputHeight; y++ {
+		srcRow := src[(crop.Min.Y+y*crop.Dy()/outputHeight)*stride:]
+		dstRow := dst[y*outputStride : (y+1)*outputStride]
+
+		if outputWidth == crop.Dx() {
+			copy(dstRow, srcRow[crop.Min.X*pixelSize:crop.Max.X*pixelSize])
+			continue
+		}
+
+		for x := 0; x < outputWidth; x++ {
+			i := (crop.Min.X + x*crop.Dx()/outputWidth) * pixelSize
+			copy(dstRow[x*pixelSize:(x+1)*pixelSize], srcRow[i:i+pixelSize])
+		}
+	}
+}
+
+func videoTransformFrame(dst []byte, src []byte, format string, width int, height int, crop image.Rectangle, outputWidth int, outputHeight int) []byte {
+	if crop == image.Rect(0, 0, width, height) && outputWidth == width && outputHeight == height {
+		return src
+	}
+
+	if format != "yuv420p" {
+		pixelSize := videoPixelFormatSize(format, 1, 1)
+		videoTransformPlane(dst, src, width*pixelSize, pixelSize, crop, outputWidth, outputHeight)
+		return dst
+	}
+
+	chromaSize := ((width + 1) / 2) * ((height + 1) / 2)
+	outputChromaWidth := (outputWidth + 1) / 2
+	outputChromaHeight := (outputHeight + 1) / 2
+	outputChromaSize := outputChromaWidth * outputChromaHeight
+	chromaCrop := image.Rect(crop.Min.X/2, crop.Min.Y/2, (crop.Max.X+1)/2, (crop.Max.Y+1)/2)
+
+	videoTransformPlane(dst, src, width, 1, crop, outputWidth, outputHeight)
+
+	for i := 0; i < 2; i++ {
+		videoTransformPlane(
+			dst[outputWidth*outputHeight+i*outputChromaSize:],
+			src[width*height+i*chromaSize:],
+			(width+1)/2,
+			1,
+			chromaCrop,
+			outputChromaWidth,
+			outputChromaHeight,
+		)
+	}
+
+	return dst
+}
+
+func videoFrameToImage(frame []byte, format string, width int, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	switch format {
+	case "rgba":
+		copy(img.Pix, frame)
+	case "bgra":
+		for i := 0; i+3 < len(frame) && i+3 < len(img.Pix); i += 4 {
+			img.Pix[i] = frame[i+2]
+			img.Pix[i+1] = frame[i+1]
+			img.Pix[i+2] = frame[i]
+			img.Pix[i+3] = frame[i+3]
+		}
+	case "rgb24":
+		for i, j := 0, 0; i+2 < len(frame) && j+3 < len(img.Pix); i, j = i+3, j+4 {
+			img.Pix[j] = frame[i]
+			img.Pix[j+1] = frame[i+1]
+			img.Pix[j+2] = frame[i+2]
+			img.Pix[j+3] = 0xFF
+		}
+	case "gray8":
+		for i, j := 0, 0; i < len(frame) && j+3 < len(img.Pix); i, j = i+1, j+4 {
+			img.Pix[j] = frame[i]
+			img.Pix[j+1] = frame[i]
+			img.Pix[j+2] = frame[i]
+			img.Pix[j+3] = 0xFF
+		}
+	case "yuv420p":
+		if len(frame) < videoPixelFormatSize(format, width, height) {
+			break
+		}
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				j := y*img.Stride + x*4
+				img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = videoFramePixel(frame, format, width, height, x, y)
+			}
+		}
+	}
+
+	return img
+}
+
+func videoFramePixel(frame []byte, format string, width int, height int, x int, y int) (byte, byte, byte, byte) {
+	switch format {
+	case "rgba":
+		i := (y*width + x) * 4
+		return frame[i], frame[i+1], frame[i+2], frame[i+3]
+	case "bgra":
+		i := (y*width + x) * 4
+		return frame[i+2], frame[i+1], frame[i], frame[i+3]
+	case "rgb24":
+		i := (y*width + x) * 3
+		return frame[i], frame[i+1], frame[i+2], 0xFF
+	case "gray8":
+		i := y*width + x
+		return frame[i], frame[i], frame[i], 0xFF
+	}
+
+	chromaWidth := (width + 1) / 2
+	chromaSize := chromaWidth * ((height + 1) / 2)
+
+	c := int(frame[y*width+x]) - 16
+	d := int(frame[width*height+(y/2)*chromaWidth+x/2]) - 128
+	e := int(frame[width*height+chromaSize+(y/2)*chromaWidth+x/2]) - 128
+
+	return videoClamp((298*c + 409*e + 128) >> 8), videoClamp((298*c - 100*d - 208*e + 128) >> 8), videoClamp((298*c + 516*d + 128) >> 8), 0xFF
+}
+
+func videoConvertFrame(img *image.RGBA, format string) []byte {
+	width := img.Rect.Dx()
+	height := img.Rect.Dy()
+	frame := make([]byte, videoPixelFormatSize(format, width, height))
+
+	switch format {
+	case "rgba":
+		copy(frame, img.Pix)
+	case "bgra":
+		for i := 0; i+3 < len(frame); i += 4 {
+			frame[i] = img.Pix[i+2]
+			frame[i+1] = img.Pix[i+1]
+			frame[i+2] = img.Pix[i]
+			frame[i+3] = img.Pix[i+3]
+		}
+	case "rgb24":
+		for i, j := 0, 0; i+2 < len(frame); i, j = i+3, j+4 {
+			frame[i] = img.Pix[j]
+			frame[i+1] = img.Pix[j+1]
+			frame[i+2] = img.Pix[j+2]
+		}
+	case "gray8":
+		for i, j := 0, 0; i < len(frame); i, j = i+1, j+4 {
+			frame[i] = byte((19595*int(img.Pix[j]) + 38470*int(img.Pix[j+1]) + 7471*int(img.Pix[j+2]) + 32768) >> 16)
+		}
+	case "yuv420p":
+		chromaWidth := (width + 1) / 2
+		chromaSize := chromaWidth * ((height + 1) / 2)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				j := y*img.Stride + x*4
+				r := int(img.Pix[j])
+				g := int(img.Pix[j+1])
+				b := int(img.Pix[j+2])
+
+				frame[y*width+x] = byte(((66*r + 129*g + 25*b + 128) >> 8) + 16)
+
+				if y%2 == 0 && x%2 == 0 {
+					frame[width*height+(y/2)*chromaWidth+x/2] = byte(((-38*r - 74*g + 112*b + 128) >> 8) + 128)
+					frame[width*height+chromaSize+(y/2)*chromaWidth+x/2] = byte(((112*r - 94*g - 18*b + 128) >> 8) + 128)
+				}
+			}
+		}
+	}
+
+	return frame
+}
+
+func videoClamp(value int) byte {
+	if value < 0 {
+		return 0
+	}
+
+	if value > 0xFF {
+		return 0xFF
+	}
+
+	return byte(value)
 }
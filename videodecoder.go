@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const videoDecoderStderrSize = 4096
+
+type videoDecoderLog struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+var videoDecoderStderr videoDecoderLog
+var videoDecoderHealthMutex sync.Mutex
+var videoDecoderRunning bool
+var videoDecoderRestarts int
+var videoDecoderStartTime time.Time
+var videoDecoderExitStatus string
+var videoDecoderExitTime time.Time
+var videoDecoderDecodeError = errors.New("decode error")
+
+func (l *videoDecoderLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.data = append(l.data, p...)
+	if len(l.data) > videoDecoderStderrSize {
+		l.data = append([]byte(nil), l.data[len(l.data)-videoDecoderStderrSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (l *videoDecoderLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return string(l.data)
+}
+
+func videoDecoderStarted() {
+	videoDecoderHealthMutex.Lock()
+	defer videoDecoderHealthMutex.Unlock()
+
+	videoDecoderRunning = true
+	videoDecoderStartTime = time.Now()
+}
+
+func videoDecoderExited(err error, crashed bool) {
+	videoDecoderHealthMutex.Lock()
+	uptime := time.Since(videoDecoderStartTime)
+	running := videoDecoderRunning
+	videoDecoderRunning = false
+
+	if crashed {
+		videoDecoderRestarts++
+		videoDecoderExitTime = time.Now()
+
+		if err != nil {
+			videoDecoderExitStatus = err.Error()
+		} else {
+			videoDecoderExitStatus = "exit status 0"
+		}
+	}
+
+	videoDecoderHealthMutex.Unlock()
+
+	if crashed && (!running || uptime < time.Second) {
+		time.Sleep(time.Second)
+	}
+}
+
+func videoDecoderRun(packets chan []byte, decoder *exec.Cmd, header bool, read func(io.Reader)) bool {
+	decoder.Stderr = io.MultiWriter(os.Stderr, &videoDecoderStderr)
+
+	decoderStdin, err := decoder.StdinPipe()
+	if err != nil {
+		videoDecoderExited(err, true)
+		return true
+	}
+
+	decoderStdout, err := decoder.StdoutPipe()
+	if err != nil {
+		videoDecoderExited(err, true)
+		return true
+	}
+
+	err = decoder.Start()
+	if err != nil {
+		videoDecoderExited(err, true)
+		return true
+	}
+
+	videoDecoderStarted()
+
+	exited := make(chan struct{})
+
+	go func() {
+		read(decoderStdout)
+		close(exited)
+	}()
+
+	var n int
+	var data []byte
+	crashed := false
+
+loop:
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				break loop
+			}
+
+			if header {
+				data = packet
+			} else {
+				data = packet[12:]
+			}
+
+			n, err = decoderStdin.Write(data)
+			if err != nil || n < len(data) {
+				crashed = true
+				break loop
+			}
+		case <-exited:
+			crashed = true
+			break loop
+		}
+	}
+
+	decoderStdin.Close()
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+	}
+
+	decoder.Process.Kill()
+	err = decoder.Wait()
+	<-exited
+
+	videoDecoderExited(err, crashed)
+
+	return crashed
+}
+
+func videoDecoderMode() string {
+	if videoDecoderIsCgo {
+		return "cgo"
+	}
+
+	if videoDecoderIsFfmpeg {
+		return "ffmpeg"
+	}
+
+	return "native"
+}
+
+func videoDecoderSendHealth(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video || !config.VideoDecoder.Enabled || config.VideoDecoder.Stream {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	videoDecoderHealthMutex.Lock()
+
+	health := struct {
+		Mode           string `json:"mode"`
+		Running        bool   `json:"running"`
+		Uptime         int64  `json:"uptime"`
+		Restarts       int    `json:"restarts"`
+		LastExitStatus string `json:"lastExitStatus,omitempty"`
+		LastExitTime   string `json:"lastExitTime,omitempty"`
+		Stderr         string `json:"stderr"`
+	}{
+		Mode:           videoDecoderMode(),
+		Running:        videoDecoderRunning,
+		Restarts:       videoDecoderRestarts,
+		LastExitStatus: videoDecoderExitStatus,
+		Stderr:         videoDecoderStderr.String(),
+	}
+
+	if videoDecoderRunning {
+		health.Uptime = time.Since(videoDecoderStartTime).Milliseconds()
+	}
+
+	if !videoDecoderExitTime.IsZero() {
+		health.LastExitTime = videoDecoderExitTime.UTC().Format(time.RFC3339)
+	}
+
+	videoDecoderHealthMutex.Unlock()
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !health.Running {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	w.Write(data)
+}
@@ -0,0 +1,226 @@
+//go:build cgo && avcodec
+
+package main
+
+/*
+#cgo pkg-config: libavcodec libavutil libswscale
+
+#include <stdlib.h>
+
+#include <libavcodec/avcodec.h>
+#include <libavutil/imgutils.h>
+#include <libswscale/swscale.h>
+
+typedef struct {
+  AVCodecParserContext *parser;
+  AVCodecContext *codec_ctx;
+  struct SwsContext *sws_ctx;
+  AVFrame *frame;
+  AVPacket *packet;
+  enum AVPixelFormat pix_fmt;
+  unsigned char *frame_data;
+  int frame_size;
+  int frame_width;
+  int frame_height;
+  int64_t frame_pts;
+} video_decoder;
+
+static void video_decoder_free(video_decoder *d) {
+  if (d->parser) {
+    av_parser_close(d->parser);
+  }
+
+  sws_freeContext(d->sws_ctx);
+  avcodec_free_context(&d->codec_ctx);
+  av_frame_free(&d->frame);
+  av_packet_free(&d->packet);
+  free(d->frame_data);
+  free(d);
+}
+
+static video_decoder *video_decoder_new(int codec_id, int pix_fmt) {
+  const AVCodec *codec = avcodec_find_decoder((enum AVCodecID)codec_id);
+  if (!codec) {
+    return NULL;
+  }
+
+  video_decoder *d = calloc(1, sizeof(video_decoder));
+  if (!d) {
+    return NULL;
+  }
+
+  d->pix_fmt = (enum AVPixelFormat)pix_fmt;
+  d->parser = av_parser_init(codec->id);
+  d->codec_ctx = avcodec_alloc_context3(codec);
+  d->frame = av_frame_alloc();
+  d->packet = av_packet_alloc();
+
+  if (!d->parser || !d->codec_ctx || !d->frame || !d->packet ||
+      avcodec_open2(d->codec_ctx, codec, NULL) < 0) {
+    video_decoder_free(d);
+    return NULL;
+  }
+
+  return d;
+}
+
+static int video_decoder_parse(video_decoder *d, unsigned char *data, int len,
+                               int64_t pts, int has_pts) {
+  if (!has_pts) {
+    pts = AV_NOPTS_VALUE;
+  }
+
+  int r = av_parser_parse2(d->parser, d->codec_ctx, &d->packet->data,
+                           &d->packet->size, data, len, pts, pts, 0);
+  if (r < 0) {
+    return -1;
+  }
+
+  if (d->packet->size != 0) {
+    if (avcodec_send_packet(d->codec_ctx, d->packet) < 0) {
+      return -1;
+    }
+
+    av_packet_unref(d->packet);
+  }
+
+  return r;
+}
+
+static int video_decoder_receive(video_decoder *d) {
+  int r = avcodec_receive_frame(d->codec_ctx, d->frame);
+  if (r == AVERROR(EAGAIN) || r == AVERROR_EOF) {
+    return 0;
+  }
+  if (r < 0) {
+    return -1;
+  }
+
+  if (d->frame_width != d->frame->width ||
+      d->frame_height != d->frame->height) {
+    d->frame_width = d->frame->width;
+    d->frame_height = d->frame->height;
+    d->frame_size = av_image_get_buffer_size(d->pix_fmt, d->frame_width,
+                                             d->frame_height, 1);
+
+    free(d->frame_data);
+    d->frame_data = malloc(d->frame_size);
+
+    if (!d->frame_data) {
+      av_frame_unref(d->frame);
+      return -1;
+    }
+  }
+
+  d->sws_ctx = sws_getCachedContext(
+      d->sws_ctx, d->frame_width, d->frame_height, d->codec_ctx->pix_fmt,
+      d->frame_width, d->frame_height, d->pix_fmt, SWS_FAST_BILINEAR, NULL,
+      NULL, NULL);
+
+  if (!d->sws_ctx) {
+    av_frame_unref(d->frame);
+    return -1;
+  }
+
+  uint8_t *planes[4];
+  int strides[4];
+
+  av_image_fill_arrays(planes, strides, d->frame_data, d->pix_fmt,
+                       d->frame_width, d->frame_height, 1);
+
+  sws_scale(d->sws_ctx, (const uint8_t *const *)d->frame->data,
+            d->frame->linesize, 0, d->frame_height, planes, strides);
+
+  d->frame_pts = d->frame->pts == AV_NOPTS_VALUE ? 0 : d->frame->pts;
+
+  av_frame_unref(d->frame);
+
+  return 1;
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+const videoCgoDecoderAvailable = true
+
+type videoCgoDecoder struct {
+	decoder *C.video_decoder
+}
+
+func videoCgoDecoderNew(codec uint32, pixelFormat string) *videoCgoDecoder {
+	codecId, ok := map[uint32]C.int{
+		0x68323634: C.AV_CODEC_ID_H264,
+		0x68323635: C.AV_CODEC_ID_HEVC,
+		0x617631:   C.AV_CODEC_ID_AV1,
+	}[codec]
+	if !ok {
+		return nil
+	}
+
+	pixFmt, ok := map[string]C.int{
+		"rgb24":   C.AV_PIX_FMT_RGB24,
+		"rgba":    C.AV_PIX_FMT_RGBA,
+		"bgra":    C.AV_PIX_FMT_BGRA,
+		"gray8":   C.AV_PIX_FMT_GRAY8,
+		"yuv420p": C.AV_PIX_FMT_YUV420P,
+	}[pixelFormat]
+	if !ok {
+		return nil
+	}
+
+	decoder := C.video_decoder_new(codecId, pixFmt)
+	if decoder == nil {
+		return nil
+	}
+
+	return &videoCgoDecoder{decoder: decoder}
+}
+
+func (d *videoCgoDecoder) decode(packet []byte, frame func([]byte, int, int, uint64)) bool {
+	payload := packet[12:]
+	pts := C.int64_t(packetPts(packet))
+	hasPts := C.int(1)
+
+	if packetIsConfig(packet) {
+		hasPts = 0
+	}
+
+	for len(payload) > 0 {
+		r := C.video_decoder_parse(d.decoder, (*C.uchar)(unsafe.Pointer(&payload[0])), C.int(len(payload)), pts, hasPts)
+		if r < 0 {
+			return false
+		}
+		if r == 0 {
+			break
+		}
+
+		payload = payload[r:]
+
+		for {
+			r = C.video_decoder_receive(d.decoder)
+			if r < 0 {
+				return false
+			}
+			if r == 0 {
+				break
+			}
+
+			frame(
+				unsafe.Slice((*byte)(unsafe.Pointer(d.decoder.frame_data)), int(d.decoder.frame_size)),
+				int(d.decoder.frame_width),
+				int(d.decoder.frame_height),
+				uint64(d.decoder.frame_pts),
+			)
+		}
+	}
+
+	return true
+}
+
+func (d *videoCgoDecoder) close() {
+	C.video_decoder_free(d.decoder)
+	d.decoder = nil
+}
@@ -0,0 +1,17 @@
+//go:build !cgo || !avcodec
+
+package main
+
+const videoCgoDecoderAvailable = false
+
+type videoCgoDecoder struct{}
+
+func videoCgoDecoderNew(codec uint32, pixelFormat string) *videoCgoDecoder {
+	return nil
+}
+
+func (d *videoCgoDecoder) decode(packet []byte, frame func([]byte, int, int, uint64)) bool {
+	return false
+}
+
+func (d *videoCgoDecoder) close() {}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type videoBitReader struct {
+	data     []byte
+	offset   int
+	overflow bool
+}
+
+var videoSizeWidth int
+var videoSizeHeight int
+var videoSizeSequence uint64
+var videoSizeUpdated chan struct{} = make(chan struct{})
+var videoSizeMutex sync.Mutex
+
+func (r *videoBitReader) readBits(n int) uint64 {
+	var value uint64
+
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.data)*8 {
+			r.overflow = true
+			return 0
+		}
+
+		value = value<<1 | uint64(r.data[r.offset/8]>>(7-r.offset%8)&1)
+		r.offset++
+	}
+
+	return value
+}
+
+func (r *videoBitReader) readFlag() bool {
+	return r.readBits(1) == 1
+}
+
+func (r *videoBitReader) readUe() uint64 {
+	leadingZeros := 0
+
+	for !r.readFlag() {
+		if r.overflow || leadingZeros >= 32 {
+			r.overflow = true
+			return 0
+		}
+
+		leadingZeros++
+	}
+
+	return (1 << leadingZeros) - 1 + r.readBits(leadingZeros)
+}
+
+func (r *videoBitReader) readSe() int64 {
+	value := r.readUe()
+
+	if value&1 != 0 {
+		return int64(value+1) / 2
+	}
+
+	return -int64(value / 2)
+}
+
+func (r *videoBitReader) readLeb128() uint64 {
+	var value uint64
+
+	for i := 0; i < 8; i++ {
+		b := r.readBits(8)
+		value |= (b & 0x7F) << (i * 7)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return value
+}
+
+func h264SpsSize(sps []byte) (int, int, bool) {
+	if len(sps) < 4 {
+		return 0, 0, false
+	}
+
+	r := &videoBitReader{data: nalUnitRbsp(sps[1:])}
+
+	profileIdc := r.readBits(8)
+	r.readBits(16)
+	r.readUe()
+
+	chromaFormatIdc := uint64(1)
+	separateColourPlane := false
+
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.readUe()
+		if chromaFormatIdc == 3 {
+			separateColourPlane = r.readFlag()
+		}
+
+		r.readUe()
+		r.readUe()
+		r.readFlag()
+
+		if r.readFlag() {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				if !r.readFlag() {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale := int64(8)
+				nextScale := int64(8)
+
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + r.readSe() + 256) % 256
+					}
+
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	r.readUe()
+
+	switch r.readUe() {
+	case 0:
+		r.readUe()
+	case 1:
+		r.readFlag()
+		r.readSe()
+		r.readSe()
+
+		count := r.readUe()
+		for i := uint64(0); i < count && !r.overflow; i++ {
+			r.readSe()
+		}
+	}
+
+	r.readUe()
+	r.readFlag()
+
+	width := int(r.readUe()+1) * 16
+	heightInMapUnits := int(r.readUe() + 1)
+
+	frameMbsOnly := r.readFlag()
+	if !frameMbsOnly {
+		r.readFlag()
+	}
+
+	r.readFlag()
+
+	height := heightInMapUnits * 16
+	if !frameMbsOnly {
+		height *= 2
+	}
+
+	if r.readFlag() {
+		cropUnitX := 1
+		cropUnitY := 1
+
+		if !separateColourPlane && chromaFormatIdc != 0 {
+			if chromaFormatIdc != 3 {
+				cropUnitX = 2
+			}
+
+			if chromaFormatIdc == 1 {
+				cropUnitY = 2
+			}
+		}
+
+		if !frameMbsOnly {
+			cropUnitY *= 2
+		}
+
+		left := int(r.readUe())
+		right := int(r.readUe())
+		top := int(r.readUe())
+		bottom := int(r.readUe())
+
+		width -= (left + right) * cropUnitX
+		height -= (top + bottom) * cropUnitY
+	}
+
+	if r.overflow || width < 1 || height < 1 {
+		return 0, 0, false
+	}
+
+	return width, height, true
+}
+
+func h265SpsSize(sps []byte) (int, int, bool) {
+	if len(sps) < 3 {
+		return 0, 0, false
+	}
+
+	r := &videoBitReader{data: nalUnitRbsp(sps[2:])}
+
+	r.readBits(4)
+	maxSubLayersMinus1 := int(r.readBits(3))
+	r.readFlag()
+
+	r.readBits(96)
+
+	subLayerProfilePresent := make([]bool, maxSubLayersMinus1)
+	subLayerLevelPresent := make([]bool, maxSubLayersMinus1)
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i] = r.readFlag()
+		subLayerLevelPresent[i] = r.readFlag()
+	}
+
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.readBits(2)
+		}
+	}
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] {
+			r.readBits(88)
+		}
+
+		if subLayerLevelPresent[i] {
+			r.readBits(8)
+		}
+	}
+
+	r.readUe()
+
+	chromaFormatIdc := r.readUe()
+	separateColourPlane := false
+	if chromaFormatIdc == 3 {
+		separateColourPlane = r.readFlag()
+	}
+
+	width := int(r.readUe())
+	height := int(r.readUe())
+
+	if r.readFlag() {
+		subWidth := 1
+		subHeight := 1
+
+		if !separateColourPlane {
+			if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+				subWidth = 2
+			}
+
+			if chromaFormatIdc == 1 {
+				subHeight = 2
+			}
+		}
+
+		left := int(r.readUe())
+		right := int(r.readUe())
+		top := int(r.readUe())
+		bottom := int(r.readUe())
+
+		width -= (left + right) * subWidth
+		height -= (top + bottom) * subHeight
+	}
+
+	if r.overflow || width < 1 || height < 1 {
+		return 0, 0, false
+	}
+
+	return width, height, true
+}
+
+func av1SequenceHeaderSize(obus []byte) (int, int, bool) {
+	if len(obus) >= 4 && obus[0] == 0x81 {
+		obus = obus[4:]
+	}
+
+	r := &videoBitReader{data: obus}
+
+	for !r.overflow && r.offset < len(obus)*8 {
+		r.readFlag()
+		obuType := r.readBits(4)
+		extension := r.readFlag()
+		hasSize := r.readFlag()
+		r.readFlag()
+
+		if extension {
+			r.readBits(8)
+		}
+
+		size := uint64(len(obus)) - uint64(r.offset/8)
+		if hasSize {
+			size = r.readLeb128()
+		}
+
+		end := r.offset + int(size)*8
+
+		if obuType != 1 {
+			r.offset = end
+			continue
+		}
+
+		r.readBits(4)
+
+		if r.readFlag() {
+			r.readBits(5)
+		} else {
+			timingInfoPresent := r.readFlag()
+			decoderModelInfoPresent := false
+			bufferDelayLength := 0
+
+			if timingInfoPresent {
+				r.readBits(64)
+
+				if r.readFlag() {
+					leadingZeros := 0
+					for !r.readFlag() && !r.overflow && leadingZeros < 32 {
+						leadingZeros++
+					}
+					r.readBits(leadingZeros)
+				}
+
+				decoderModelInfoPresent = r.readFlag()
+				if decoderModelInfoPresent {
+					bufferDelayLength = int(r.readBits(5)) + 1
+					r.readBits(42)
+				}
+			}
+
+			initialDisplayDelayPresent := r.readFlag()
+			operatingPoints := int(r.readBits(5)) + 1
+
+			for i := 0; i < operatingPoints; i++ {
+				r.readBits(12)
+
+				if r.readBits(5) > 7 {
+					r.readFlag()
+				}
+
+				if decoderModelInfoPresent && r.readFlag() {
+					r.readBits(bufferDelayLength*2 + 1)
+				}
+
+				if initialDisplayDelayPresent && r.readFlag() {
+					r.readBits(4)
+				}
+			}
+		}
+
+		widthBits := int(r.readBits(4)) + 1
+		heightBits := int(r.readBits(4)) + 1
+		width := int(r.readBits(widthBits)) + 1
+		height := int(r.readBits(heightBits)) + 1
+
+		if r.overflow {
+			return 0, 0, false
+		}
+
+		return width, height, true
+	}
+
+	return 0, 0, false
+}
+
+func videoConfigSize(codec uint32, config []byte) (int, int, bool) {
+	switch codec {
+	case 0x68323634:
+		for _, nalUnit := range annexbNalUnits(config) {
+			if len(nalUnit) > 0 && nalUnit[0]&0x1F == 7 {
+				return h264SpsSize(nalUnit)
+			}
+		}
+	case 0x68323635:
+		for _, nalUnit := range annexbNalUnits(config) {
+			if len(nalUnit) > 0 && (nalUnit[0]>>1)&0x3F == 33 {
+				return h265SpsSize(nalUnit)
+			}
+		}
+	case 0x617631:
+		return av1SequenceHeaderSize(config)
+	}
+
+	return 0, 0, false
+}
+
+func videoSizeSet(width int, height int) {
+	videoSizeMutex.Lock()
+	defer videoSizeMutex.Unlock()
+
+	if width == videoSizeWidth && height == videoSizeHeight {
+		return
+	}
+
+	videoSizeWidth = width
+	videoSizeHeight = height
+	videoSizeSequence++
+	close(videoSizeUpdated)
+	videoSizeUpdated = make(chan struct{})
+}
+
+func videoSizeGet() (int, int) {
+	videoSizeMutex.Lock()
+	defer videoSizeMutex.Unlock()
+
+	return videoSizeWidth, videoSizeHeight
+}
+
+func videoSizeTrack() {
+	for {
+		packets := videoBroadcaster.subscribe(nil)
+
+		videoSizeSet(initialVideoWidth, initialVideoHeight)
+
+		for packet := range packets {
+			if !packetIsConfig(packet) {
+				continue
+			}
+
+			width, height, ok := videoConfigSize(videoCodec, packet[12:])
+			if ok {
+				videoSizeSet(width, height)
+			}
+		}
+	}
+}
+
+func videoSizeSend(w http.ResponseWriter, req *http.Request) {
+	width, height := videoSizeGet()
+
+	if !config.Scrcpy.Video || width == 0 || height == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Width, Height")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Width", strconv.Itoa(width))
+	w.Header().Set("Height", strconv.Itoa(height))
+	fmt.Fprintf(w, "{\"width\":%d,\"height\":%d}", width, height)
+}
+
+func videoSizeSendStream(w http.ResponseWriter, req *http.Request) {
+	if !config.Scrcpy.Video {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var sequence uint64
+	var err error
+
+	for {
+		videoSizeMutex.Lock()
+		width := videoSizeWidth
+		height := videoSizeHeight
+		changed := videoSizeSequence != sequence
+		sequence = videoSizeSequence
+		updated := videoSizeUpdated
+		videoSizeMutex.Unlock()
+
+		if changed && width != 0 && height != 0 {
+			_, err = fmt.Fprintf(w, "{\"width\":%d,\"height\":%d}\n", width, height)
+			if err != nil {
+				return
+			}
+
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-updated:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
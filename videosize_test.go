@@ -0,0 +1,530 @@
+package main
+
+import (
+	"testing"
+)
+
+type videoBitWriter struct {
+	data  []byte
+	count int
+}
+
+func (w *videoBitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.count%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.count%8)
+		w.count++
+	}
+}
+
+func (w *videoBitWriter) writeFlag(v bool) {
+	if v {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+func (w *videoBitWriter) writeUe(v uint64) {
+	n := 0
+	for (v+1)>>n > 1 {
+		n++
+	}
+
+	w.writeBits(0, n)
+	w.writeBits(v+1, n+1)
+}
+
+func (w *videoBitWriter) writeSe(v int64) {
+	if v > 0 {
+		w.writeUe(uint64(v)*2 - 1)
+	} else {
+		w.writeUe(uint64(-v) * 2)
+	}
+}
+
+func (w *videoBitWriter) writeLeb128(v uint64) {
+	for {
+		b := v & 0x7F
+		v >>= 7
+
+		if v != 0 {
+			w.writeBits(b|0x80, 8)
+		} else {
+			w.writeBits(b, 8)
+			return
+		}
+	}
+}
+
+func (w *videoBitWriter) nalUnit(header ...byte) []byte {
+	w.writeBits(1, 1)
+	for w.count%8 != 0 {
+		w.writeBits(0, 1)
+	}
+
+	nalUnit := append([]byte{}, header...)
+	zeros := 0
+
+	for _, b := range w.data {
+		if zeros >= 2 && b <= 3 {
+			nalUnit = append(nalUnit, 3)
+			zeros = 0
+		}
+
+		nalUnit = append(nalUnit, b)
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return nalUnit
+}
+
+type h264SpsTest struct {
+	profileIdc      uint64
+	chromaFormatIdc uint64
+	scalingLists    [][]int64
+	pocType         uint64
+	widthInMbs      uint64
+	heightInMapUnit uint64
+	frameMbsOnly    bool
+	crop            []uint64
+	vui             bool
+}
+
+func h264TestSps(t h264SpsTest) []byte {
+	w := &videoBitWriter{}
+
+	w.writeBits(t.profileIdc, 8)
+	w.writeBits(0, 8)
+	w.writeBits(40, 8)
+	w.writeUe(0)
+
+	if t.profileIdc >= 100 {
+		w.writeUe(t.chromaFormatIdc)
+		if t.chromaFormatIdc == 3 {
+			w.writeFlag(false)
+		}
+
+		w.writeUe(0)
+		w.writeUe(0)
+		w.writeFlag(false)
+
+		w.writeFlag(t.scalingLists != nil)
+		if t.scalingLists != nil {
+			count := 8
+			if t.chromaFormatIdc == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				if i >= len(t.scalingLists) || t.scalingLists[i] == nil {
+					w.writeFlag(false)
+					continue
+				}
+
+				w.writeFlag(true)
+				for _, delta := range t.scalingLists[i] {
+					w.writeSe(delta)
+				}
+			}
+		}
+	}
+
+	w.writeUe(0)
+	w.writeUe(t.pocType)
+
+	switch t.pocType {
+	case 0:
+		w.writeUe(2)
+	case 1:
+		w.writeFlag(false)
+		w.writeSe(-1)
+		w.writeSe(2)
+		w.writeUe(2)
+		w.writeSe(1)
+		w.writeSe(-3)
+	}
+
+	w.writeUe(4)
+	w.writeFlag(false)
+	w.writeUe(t.widthInMbs - 1)
+	w.writeUe(t.heightInMapUnit - 1)
+
+	w.writeFlag(t.frameMbsOnly)
+	if !t.frameMbsOnly {
+		w.writeFlag(false)
+	}
+
+	w.writeFlag(true)
+
+	w.writeFlag(t.crop != nil)
+	for _, offset := range t.crop {
+		w.writeUe(offset)
+	}
+
+	w.writeFlag(t.vui)
+	if t.vui {
+		w.writeFlag(true)
+		w.writeBits(255, 8)
+		w.writeBits(1, 16)
+		w.writeBits(1, 16)
+		w.writeFlag(false)
+		w.writeFlag(true)
+		w.writeBits(5, 3)
+		w.writeFlag(false)
+		w.writeFlag(false)
+		w.writeFlag(false)
+		w.writeFlag(true)
+		w.writeBits(1000, 32)
+		w.writeBits(60000, 32)
+		w.writeFlag(true)
+	}
+
+	return w.nalUnit(0x67)
+}
+
+func TestH264SpsSize(t *testing.T) {
+	flatScalingList := make([]int64, 16)
+	zeroScalingList := []int64{-8}
+	rampScalingList := make([]int64, 64)
+	for i := range rampScalingList {
+		rampScalingList[i] = int64(i%5 - 2)
+	}
+
+	tests := []struct {
+		name   string
+		sps    h264SpsTest
+		width  int
+		height int
+	}{
+		{"baseline", h264SpsTest{profileIdc: 66, pocType: 2, widthInMbs: 80, heightInMapUnit: 45, frameMbsOnly: true}, 1280, 720},
+		{"baseline cropped", h264SpsTest{profileIdc: 66, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}}, 1920, 1080},
+		{"main poc type 0", h264SpsTest{profileIdc: 77, pocType: 0, widthInMbs: 45, heightInMapUnit: 98, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}}, 720, 1560},
+		{"main poc type 1", h264SpsTest{profileIdc: 77, pocType: 1, widthInMbs: 68, heightInMapUnit: 150, frameMbsOnly: true, crop: []uint64{0, 4, 0, 0}}, 1080, 2400},
+		{"high", h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 68, heightInMapUnit: 147, frameMbsOnly: true, crop: []uint64{0, 4, 0, 4}}, 1080, 2344},
+		{"high vui", h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 0, widthInMbs: 68, heightInMapUnit: 150, frameMbsOnly: true, crop: []uint64{0, 4, 0, 0}, vui: true}, 1080, 2400},
+		{"high scaling lists", h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, scalingLists: [][]int64{flatScalingList, nil, zeroScalingList, nil, nil, nil, rampScalingList, zeroScalingList}, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}, vui: true}, 1920, 1080},
+		{"high 4:4:4 scaling lists", h264SpsTest{profileIdc: 244, chromaFormatIdc: 3, scalingLists: [][]int64{nil, flatScalingList, nil, nil, nil, nil, nil, nil, nil, nil, nil, rampScalingList}, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 8}}, 1920, 1080},
+		{"high 4:2:2 cropped", h264SpsTest{profileIdc: 122, chromaFormatIdc: 2, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{1, 1, 0, 8}}, 1916, 1080},
+		{"monochrome cropped", h264SpsTest{profileIdc: 100, chromaFormatIdc: 0, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 8}}, 1920, 1080},
+		{"interlaced", h264SpsTest{profileIdc: 77, pocType: 0, widthInMbs: 120, heightInMapUnit: 34, frameMbsOnly: false, crop: []uint64{0, 0, 0, 2}}, 1920, 1080},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, ok := h264SpsSize(h264TestSps(test.sps))
+			if !ok || width != test.width || height != test.height {
+				t.Errorf("got %dx%d %v, want %dx%d", width, height, ok, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestH264SpsSizeInvalid(t *testing.T) {
+	sps := h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 120, heightInMapUnit: 68, frameMbsOnly: true, crop: []uint64{0, 0, 0, 4}})
+
+	tests := []struct {
+		name string
+		sps  []byte
+	}{
+		{"empty", nil},
+		{"short", sps[:3]},
+		{"truncated", sps[:8]},
+		{"cropped away", h264TestSps(h264SpsTest{profileIdc: 66, pocType: 2, widthInMbs: 1, heightInMapUnit: 1, frameMbsOnly: true, crop: []uint64{4, 4, 0, 0}})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if width, height, ok := h264SpsSize(test.sps); ok {
+				t.Errorf("got %dx%d, want failure", width, height)
+			}
+		})
+	}
+}
+
+type h265SpsTest struct {
+	maxSubLayersMinus1 int
+	chromaFormatIdc    uint64
+	width              uint64
+	height             uint64
+	conformanceWindow  []uint64
+}
+
+func h265TestSps(t h265SpsTest) []byte {
+	w := &videoBitWriter{}
+
+	w.writeBits(0, 4)
+	w.writeBits(uint64(t.maxSubLayersMinus1), 3)
+	w.writeFlag(true)
+
+	w.writeBits(0, 2)
+	w.writeFlag(false)
+	w.writeBits(1, 5)
+	w.writeBits(0x60000000, 32)
+	w.writeBits(0x9, 4)
+	w.writeBits(0, 43)
+	w.writeFlag(false)
+	w.writeBits(120, 8)
+
+	for i := 0; i < t.maxSubLayersMinus1; i++ {
+		w.writeFlag(i%2 == 0)
+		w.writeFlag(true)
+	}
+
+	if t.maxSubLayersMinus1 > 0 {
+		for i := t.maxSubLayersMinus1; i < 8; i++ {
+			w.writeBits(0, 2)
+		}
+	}
+
+	for i := 0; i < t.maxSubLayersMinus1; i++ {
+		if i%2 == 0 {
+			w.writeBits(0x0AAAAAAAAAAAAAAA, 64)
+			w.writeBits(0x555555, 24)
+		}
+
+		w.writeBits(90, 8)
+	}
+
+	w.writeUe(0)
+	w.writeUe(t.chromaFormatIdc)
+	if t.chromaFormatIdc == 3 {
+		w.writeFlag(false)
+	}
+
+	w.writeUe(t.width)
+	w.writeUe(t.height)
+
+	w.writeFlag(t.conformanceWindow != nil)
+	for _, offset := range t.conformanceWindow {
+		w.writeUe(offset)
+	}
+
+	w.writeUe(0)
+	w.writeUe(0)
+	w.writeUe(4)
+
+	return w.nalUnit(0x42, 0x01)
+}
+
+func TestH265SpsSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    h265SpsTest
+		width  int
+		height int
+	}{
+		{"uncropped", h265SpsTest{chromaFormatIdc: 1, width: 1280, height: 720}, 1280, 720},
+		{"conformance window", h265SpsTest{chromaFormatIdc: 1, width: 1920, height: 1088, conformanceWindow: []uint64{0, 0, 0, 4}}, 1920, 1080},
+		{"conformance window 4:4:4", h265SpsTest{chromaFormatIdc: 3, width: 1920, height: 1088, conformanceWindow: []uint64{0, 0, 0, 8}}, 1920, 1080},
+		{"conformance window 4:2:2", h265SpsTest{chromaFormatIdc: 2, width: 1088, height: 2400, conformanceWindow: []uint64{2, 2, 0, 0}}, 1080, 2400},
+		{"sub layers", h265SpsTest{maxSubLayersMinus1: 3, chromaFormatIdc: 1, width: 1080, height: 2408, conformanceWindow: []uint64{0, 0, 0, 4}}, 1080, 2400},
+		{"max sub layers", h265SpsTest{maxSubLayersMinus1: 7, chromaFormatIdc: 1, width: 720, height: 1600}, 720, 1600},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, ok := h265SpsSize(h265TestSps(test.sps))
+			if !ok || width != test.width || height != test.height {
+				t.Errorf("got %dx%d %v, want %dx%d", width, height, ok, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestH265SpsSizeInvalid(t *testing.T) {
+	sps := h265TestSps(h265SpsTest{chromaFormatIdc: 1, width: 1920, height: 1088, conformanceWindow: []uint64{0, 0, 0, 4}})
+
+	tests := []struct {
+		name string
+		sps  []byte
+	}{
+		{"empty", nil},
+		{"short", sps[:2]},
+		{"truncated", sps[:12]},
+		{"cropped away", h265TestSps(h265SpsTest{chromaFormatIdc: 1, width: 16, height: 16, conformanceWindow: []uint64{4, 4, 0, 0}})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if width, height, ok := h265SpsSize(test.sps); ok {
+				t.Errorf("got %dx%d, want failure", width, height)
+			}
+		})
+	}
+}
+
+type av1SequenceHeaderTest struct {
+	reduced              bool
+	timingInfo           bool
+	equalPictureInterval bool
+	decoderModelInfo     bool
+	initialDisplayDelay  bool
+	operatingPoints      int
+	width                uint64
+	height               uint64
+}
+
+func av1TestObus(t av1SequenceHeaderTest) []byte {
+	w := &videoBitWriter{}
+
+	w.writeBits(0, 3)
+	w.writeFlag(t.reduced)
+	w.writeFlag(t.reduced)
+
+	if t.reduced {
+		w.writeBits(8, 5)
+	} else {
+		w.writeFlag(t.timingInfo)
+		if t.timingInfo {
+			w.writeBits(1, 32)
+			w.writeBits(60, 32)
+			w.writeFlag(t.equalPictureInterval)
+			if t.equalPictureInterval {
+				w.writeUe(5)
+			}
+
+			w.writeFlag(t.decoderModelInfo)
+			if t.decoderModelInfo {
+				w.writeBits(9, 5)
+				w.writeBits(90000, 32)
+				w.writeBits(31, 5)
+				w.writeBits(31, 5)
+			}
+		}
+
+		w.writeFlag(t.initialDisplayDelay)
+		w.writeBits(uint64(t.operatingPoints-1), 5)
+
+		for i := 0; i < t.operatingPoints; i++ {
+			w.writeBits(uint64(i), 12)
+			w.writeBits(uint64(i*4), 5)
+			if i*4 > 7 {
+				w.writeFlag(true)
+			}
+
+			if t.decoderModelInfo {
+				w.writeFlag(true)
+				w.writeBits(0x3FF, 10)
+				w.writeBits(0x2AA, 10)
+				w.writeFlag(false)
+			}
+
+			if t.initialDisplayDelay {
+				w.writeFlag(true)
+				w.writeBits(9, 4)
+			}
+		}
+	}
+
+	w.writeBits(11, 4)
+	w.writeBits(11, 4)
+	w.writeBits(t.width-1, 12)
+	w.writeBits(t.height-1, 12)
+	w.writeFlag(false)
+	w.writeBits(1, 1)
+	for w.count%8 != 0 {
+		w.writeBits(0, 1)
+	}
+
+	payload := w.data
+
+	w = &videoBitWriter{}
+	w.writeBits(0x12, 8)
+	w.writeLeb128(0)
+
+	w.writeBits(0x0A, 8)
+	w.writeLeb128(uint64(len(payload)))
+
+	return append(w.data, payload...)
+}
+
+func TestAv1SequenceHeaderSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		header av1SequenceHeaderTest
+		width  int
+		height int
+	}{
+		{"reduced still picture", av1SequenceHeaderTest{reduced: true, width: 1280, height: 720}, 1280, 720},
+		{"single operating point", av1SequenceHeaderTest{operatingPoints: 1, width: 1080, height: 2400}, 1080, 2400},
+		{"operating points", av1SequenceHeaderTest{operatingPoints: 4, width: 1920, height: 1080}, 1920, 1080},
+		{"timing info", av1SequenceHeaderTest{timingInfo: true, equalPictureInterval: true, operatingPoints: 1, width: 720, height: 1600}, 720, 1600},
+		{"decoder model", av1SequenceHeaderTest{timingInfo: true, decoderModelInfo: true, initialDisplayDelay: true, operatingPoints: 3, width: 1920, height: 1080}, 1920, 1080},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obus := av1TestObus(test.header)
+
+			width, height, ok := av1SequenceHeaderSize(obus)
+			if !ok || width != test.width || height != test.height {
+				t.Errorf("got %dx%d %v, want %dx%d", width, height, ok, test.width, test.height)
+			}
+
+			width, height, ok = av1SequenceHeaderSize(append([]byte{0x81, 0x00, 0x0C, 0x00}, obus...))
+			if !ok || width != test.width || height != test.height {
+				t.Errorf("av1C prefixed: got %dx%d %v, want %dx%d", width, height, ok, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestAv1SequenceHeaderSizeInvalid(t *testing.T) {
+	obus := av1TestObus(av1SequenceHeaderTest{operatingPoints: 1, width: 1920, height: 1080})
+
+	tests := []struct {
+		name string
+		obus []byte
+	}{
+		{"empty", nil},
+		{"temporal delimiter only", obus[:2]},
+		{"truncated", obus[:len(obus)-4]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if width, height, ok := av1SequenceHeaderSize(test.obus); ok {
+				t.Errorf("got %dx%d, want failure", width, height)
+			}
+		})
+	}
+}
+
+func TestVideoConfigSize(t *testing.T) {
+	h264Sps := h264TestSps(h264SpsTest{profileIdc: 100, chromaFormatIdc: 1, pocType: 2, widthInMbs: 68, heightInMapUnit: 150, frameMbsOnly: true, crop: []uint64{0, 4, 0, 0}, vui: true})
+	h265Sps := h265TestSps(h265SpsTest{chromaFormatIdc: 1, width: 1088, height: 2400, conformanceWindow: []uint64{0, 4, 0, 0}})
+
+	tests := []struct {
+		name   string
+		codec  uint32
+		config []byte
+		width  int
+		height int
+		ok     bool
+	}{
+		{"h264", 0x68323634, append(append([]byte{0, 0, 0, 1}, h264Sps...), 0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80), 1080, 2400, true},
+		{"h264 after pps", 0x68323634, append([]byte{0, 0, 1, 0x68, 0xEE, 0x3C, 0x80, 0, 0, 1}, h264Sps...), 1080, 2400, true},
+		{"h264 without sps", 0x68323634, []byte{0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80}, 0, 0, false},
+		{"h265", 0x68323635, append(append([]byte{0, 0, 0, 1, 0x40, 0x01, 0x0C, 0x01, 0, 0, 0, 1}, h265Sps...), 0, 0, 0, 1, 0x44, 0x01, 0xC1, 0x72), 1080, 2400, true},
+		{"av1", 0x617631, av1TestObus(av1SequenceHeaderTest{operatingPoints: 1, width: 1080, height: 2400}), 1080, 2400, true},
+		{"unknown codec", 0x00726177, h264Sps, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, ok := videoConfigSize(test.codec, test.config)
+			if ok != test.ok || width != test.width || height != test.height {
+				t.Errorf("got %dx%d %v, want %dx%d %v", width, height, ok, test.width, test.height, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+type webpBitWriter struct {
+	data  []byte
+	value uint64
+	bits  uint
+}
+
+func (b *webpBitWriter) write(value uint64, bits uint) {
+	b.value |= value << b.bits
+	b.bits += bits
+
+	for b.bits >= 8 {
+		b.data = append(b.data, byte(b.value))
+		b.value >>= 8
+		b.bits -= 8
+	}
+}
+
+func (b *webpBitWriter) writeCode(code uint64, bits uint) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		b.write((code>>uint(i))&1, 1)
+	}
+}
+
+func (b *webpBitWriter) bytes() []byte {
+	if b.bits > 0 {
+		b.data = append(b.data, byte(b.value))
+		b.value = 0
+		b.bits = 0
+	}
+
+	return b.data
+}
+
+func webpWriteSimpleCode(b *webpBitWriter, symbol uint64) {
+	b.write(1, 1)
+	b.write(0, 1)
+
+	if symbol < 2 {
+		b.write(0, 1)
+		b.write(symbol, 1)
+	} else {
+		b.write(1, 1)
+		b.write(symbol, 8)
+	}
+}
+
+func webpWriteLiteralCode(b *webpBitWriter, symbols int) {
+	b.write(0, 1)
+	b.write(12-4, 4)
+
+	for i := 0; i < 12; i++ {
+		if i == 2 || i == 11 {
+			b.write(1, 3)
+		} else {
+			b.write(0, 3)
+		}
+	}
+
+	b.write(0, 1)
+
+	for i := 0; i < symbols; i++ {
+		if i < 256 {
+			b.write(1, 1)
+		} else {
+			b.write(0, 1)
+		}
+	}
+}
+
+func webpEncode(w io.Writer, img *image.RGBA) error {
+	width := img.Rect.Dx()
+	height := img.Rect.Dy()
+
+	opaque := img.Opaque()
+
+	var b webpBitWriter
+
+	b.write(0x2F, 8)
+	b.write(uint64(width-1), 14)
+	b.write(uint64(height-1), 14)
+	if opaque {
+		b.write(0, 1)
+	} else {
+		b.write(1, 1)
+	}
+	b.write(0, 3)
+
+	b.write(0, 1)
+	b.write(0, 1)
+	b.write(0, 1)
+
+	webpWriteLiteralCode(&b, 256+24)
+	webpWriteLiteralCode(&b, 256)
+	webpWriteLiteralCode(&b, 256)
+	if opaque {
+		webpWriteSimpleCode(&b, 0xFF)
+	} else {
+		webpWriteLiteralCode(&b, 256)
+	}
+	webpWriteSimpleCode(&b, 0)
+
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+
+		for x := 0; x < len(row); x += 4 {
+			b.writeCode(uint64(row[x+1]), 8)
+			b.writeCode(uint64(row[x]), 8)
+			b.writeCode(uint64(row[x+2]), 8)
+			if !opaque {
+				b.writeCode(uint64(row[x+3]), 8)
+			}
+		}
+	}
+
+	chunk := b.bytes()
+
+	riffSize := 4 + 8 + len(chunk) + len(chunk)%2
+
+	header := []byte("RIFF")
+	header = binary.LittleEndian.AppendUint32(header, uint32(riffSize))
+	header = append(header, "WEBPVP8L"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(chunk)))
+
+	if len(chunk)%2 != 0 {
+		chunk = append(chunk, 0)
+	}
+
+	_, err := w.Write(append(header, chunk...))
+
+	return err
+}
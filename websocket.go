@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const webSocketMaxMessageSize = 1 << 20
+const webSocketCommandQueueSize = 64
+
+type webSocketBroadcaster struct {
+	mutex       sync.Mutex
+	subscribers map[chan string]struct{}
+}
+
+var webSocketClipboardBroadcaster = newWebSocketBroadcaster()
+var webSocketUhidKeyboardOutputBroadcaster = newWebSocketBroadcaster()
+
+type webSocketCommands struct {
+	sequence int
+	commands [][]string
+}
+
+type webSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+func newWebSocketBroadcaster() *webSocketBroadcaster {
+	return &webSocketBroadcaster{
+		subscribers: make(map[chan string]struct{}),
+	}
+}
+
+func (b *webSocketBroadcaster) subscribe() chan string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c := make(chan string, webSocketCommandQueueSize)
+	b.subscribers[c] = struct{}{}
+
+	return c
+}
+
+func (b *webSocketBroadcaster) unsubscribe(c chan string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, c)
+}
+
+func (b *webSocketBroadcaster) publish(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for c := range b.subscribers {
+		select {
+		case c <- line:
+		default:
+		}
+	}
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) bool {
+	header := []byte{0x80 | opcode}
+
+	if len(payload) < 126 {
+		header = append(header, byte(len(payload)))
+	} else if len(payload) <= 0xFFFF {
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	} else {
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := c.conn.Write(append(header, payload...))
+
+	return err == nil
+}
+
+func (c *webSocketConn) readFrame() (bool, byte, []byte, bool) {
+	header := make([]byte, 2)
+
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, false
+	}
+
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, false
+	}
+
+	size := uint64(header[1] & 0x7F)
+
+	switch size {
+	case 126:
+		data := make([]byte, 2)
+
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return false, 0, nil, false
+		}
+
+		size = uint64(binary.BigEndian.Uint16(data))
+	case 127:
+		data := make([]byte, 8)
+
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return false, 0, nil, false
+		}
+
+		size = binary.BigEndian.Uint64(data)
+	}
+
+	if size > webSocketMaxMessageSize {
+		return false, 0, nil, false
+	}
+
+	data := make([]byte, 4+size)
+
+	_, err = io.ReadFull(c.reader, data)
+	if err != nil {
+		return false, 0, nil, false
+	}
+
+	payload := data[4:]
+	for i := range payload {
+		payload[i] ^= data[i%4]
+	}
+
+	return header[0]&0x80 != 0, header[0] & 0x0F, payload, true
+}
+
+func (c *webSocketConn) readMessages(messages chan []byte) {
+	defer close(messages)
+
+	var message []byte
+
+	for {
+		fin, opcode, payload, ok := c.readFrame()
+		if !ok {
+			return
+		}
+
+		switch opcode {
+		case 0x00, 0x01, 0x02:
+			if opcode != 0x00 {
+				message = nil
+			}
+
+			if len(message)+len(payload) > webSocketMaxMessageSize {
+				return
+			}
+
+			message = append(message, payload...)
+
+			if fin {
+				messages <- message
+				message = nil
+			}
+		case 0x08:
+			if len(payload) >= 2 {
+				c.writeFrame(0x08, payload[:2])
+			} else {
+				c.writeFrame(0x08, nil)
+			}
+
+			return
+		case 0x09:
+			if !c.writeFrame(0x0A, payload) {
+				return
+			}
+		}
+	}
+}
+
+func webSocketSendVideo(c *webSocketConn, done chan struct{}) {
+	for {
+		packets := videoBroadcaster.subscribe(done)
+		if packets == nil {
+			return
+		}
+
+		width, height := videoSizeGet()
+
+		if !c.writeFrame(0x01, []byte(fmt.Sprintf("{\"type\":\"video\",\"codec\":%d,\"width\":%d,\"height\":%d}", videoCodec, width, height))) {
+			videoBroadcaster.unsubscribe(packets)
+			return
+		}
+
+	loop:
+		for {
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					break loop
+				}
+
+				if !c.writeFrame(0x02, packet) {
+					videoBroadcaster.unsubscribe(packets)
+					return
+				}
+			case <-done:
+				videoBroadcaster.unsubscribe(packets)
+				return
+			}
+		}
+	}
+}
+
+func webSocketSendControl(c *webSocketConn, done chan struct{}) {
+	clipboard := webSocketClipboardBroadcaster.subscribe()
+	defer webSocketClipboardBroadcaster.unsubscribe(clipboard)
+
+	uhidKeyboardOutput := webSocketUhidKeyboardOutputBroadcaster.subscribe()
+	defer webSocketUhidKeyboardOutputBroadcaster.unsubscribe(uhidKeyboardOutput)
+
+	var line string
+
+	for {
+		select {
+		case line = <-clipboard:
+			line = "{\"type\":\"clipboard\",\"data\":" + line + "}"
+		case line = <-uhidKeyboardOutput:
+			line = "{\"type\":\"uhidKeyboardOutput\",\"data\":\"" + line + "\"}"
+		case <-done:
+			return
+		}
+
+		if !c.writeFrame(0x01, []byte(line)) {
+			return
+		}
+	}
+}
+
+func webSocketHandle(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+
+	if !originAllowed(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err != nil {
+		return
+	}
+
+	c := &webSocketConn{
+		conn:   conn,
+		reader: rw.Reader,
+	}
+
+	done := make(chan struct{})
+	messages := make(chan []byte)
+	queue := make(chan webSocketCommands, webSocketCommandQueueSize)
+
+	go c.readMessages(messages)
+
+	go func() {
+		for {
+			select {
+			case queued := <-queue:
+				outputs := make([]string, len(queued.commands))
+				completed := commandsRun(queued.commands, outputs, false)
+
+				data, err := commandsResults(queued.commands, outputs, completed)
+				if err != nil {
+					c.writeFrame(0x01, []byte(fmt.Sprintf("{\"type\":\"error\",\"sequence\":%d,\"error\":\"invalid result\"}", queued.sequence)))
+					continue
+				}
+
+				c.writeFrame(0x01, []byte(fmt.Sprintf("{\"type\":\"result\",\"sequence\":%d,\"ok\":%t,\"results\":%s}", queued.sequence, completed == len(queued.commands), data)))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if config.Scrcpy.Video {
+		go webSocketSendVideo(c, done)
+	}
+
+	if config.Scrcpy.Control {
+		go webSocketSendControl(c, done)
+	}
+
+	sequence := 0
+
+	for message := range messages {
+		var commands [][]string
+
+		sequence++
+
+		err = json.Unmarshal(message, &commands)
+		if err != nil || len(commands) == 0 {
+			c.writeFrame(0x01, []byte(fmt.Sprintf("{\"type\":\"error\",\"sequence\":%d,\"error\":\"invalid commands\"}", sequence)))
+			continue
+		}
+
+		queue <- webSocketCommands{sequence: sequence, commands: commands}
+	}
+
+	close(done)
+}